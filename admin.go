@@ -0,0 +1,226 @@
+package bchauth
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func init() {
+	caddy.RegisterModule(adminAPI{})
+}
+
+// instances holds the provisioned handlers, so that admin API requests can
+// reach their runtime state.
+var instances = struct {
+	sync.Mutex
+	set map[*BchAuth]struct{}
+}{set: make(map[*BchAuth]struct{})}
+
+func registerInstance(bch *BchAuth) {
+	instances.Lock()
+	instances.set[bch] = struct{}{}
+	instances.Unlock()
+}
+
+func unregisterInstance(bch *BchAuth) {
+	instances.Lock()
+	delete(instances.set, bch)
+	instances.Unlock()
+}
+
+// cacheConflict reports whether a provisioned handler other than bch
+// writes to the same cache_namespace but decides access differently, so
+// that a grant cached by one would be honored by the other. During a config
+// reload the handlers of the old config still count.
+func cacheConflict(bch *BchAuth) bool {
+	fingerprint := cacheFingerprint(bch)
+	instances.Lock()
+	defer instances.Unlock()
+	for other := range instances.set {
+		if other == bch || other.CacheNamespace != bch.CacheNamespace {
+			continue
+		}
+		if cacheFingerprint(other) != fingerprint {
+			return true
+		}
+	}
+	return false
+}
+
+// cacheFingerprint encodes the options that decide which keys get access
+// and for how long, and so what is cached for them. Wallets and routes are
+// sorted, so that their order does not matter.
+func cacheFingerprint(bch *BchAuth) string {
+	wallets := slices.Clone(bch.DestWallets)
+	slices.Sort(wallets)
+	routes := slices.Clone(bch.Routes)
+	slices.SortFunc(routes, func(a, b RoutePrice) int { return strings.Compare(a.Prefix, b.Prefix) })
+	billingUnit := bch.BillingUnit
+	if billingUnit == "" {
+		billingUnit = billingUnitDay
+	}
+	fingerprint, _ := json.Marshal([]interface{}{
+		wallets, bch.MinFundsCTN, bch.Tiers, routes, billingUnit,
+		bch.MaxServiceDays, bch.MaxTxAge, bch.GracePeriod,
+		bch.AccumulatePartialPayments, bch.EnableLinkedAddresses, bch.MatchSender,
+		bch.KeyType, bch.NetworkId, bch.PubKeyEncoding,
+		bch.DBDriver, bch.PGSchema, bch.PGTable, bch.AccessCheckerRaw,
+	})
+	return string(fingerprint)
+}
+
+// instancesBySecret returns the handlers whose admin_secret is secret.
+// Handlers without an admin_secret never match.
+func instancesBySecret(secret string) []*BchAuth {
+	instances.Lock()
+	defer instances.Unlock()
+	var matched []*BchAuth
+	for bch := range instances.set {
+		if bch.AdminSecret != "" && subtle.ConstantTimeCompare([]byte(secret), []byte(bch.AdminSecret)) == 1 {
+			matched = append(matched, bch)
+		}
+	}
+	return matched
+}
+
+// adminAPI serves the bchauth endpoints of the Caddy admin API.
+type adminAPI struct{}
+
+// CaddyModule returns the Caddy module information.
+func (adminAPI) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "admin.api.bchauth",
+		New: func() caddy.Module { return new(adminAPI) },
+	}
+}
+
+// Routes returns the admin routes for the bchauth module.
+func (a adminAPI) Routes() []caddy.AdminRoute {
+	return []caddy.AdminRoute{
+		{Pattern: "/bchauth/version", Handler: caddy.AdminHandlerFunc(a.handleVersion)},
+		{Pattern: "/bchauth/whitelist", Handler: caddy.AdminHandlerFunc(a.handleWhitelist)},
+	}
+}
+
+// handleVersion reports the build information of the module.
+func (adminAPI) handleVersion(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(ReadBuildInfo())
+}
+
+// whitelistRequest is the body of whitelist POST and DELETE requests.
+type whitelistRequest struct {
+	PubKey string `json:"pub_key"`
+}
+
+// handleWhitelist lists (GET), adds (POST) or removes (DELETE) runtime
+// whitelist keys of every handler whose admin_secret matches the
+// X-Admin-Secret header. Changes are written to whitelist_file when one is
+// configured, so they survive its reloads. A change that cannot be saved
+// for every handler is undone for all of them.
+func (adminAPI) handleWhitelist(w http.ResponseWriter, r *http.Request) error {
+	targets := instancesBySecret(r.Header.Get("X-Admin-Secret"))
+	if len(targets) == 0 {
+		return caddy.APIError{
+			HTTPStatus: http.StatusForbidden,
+			Err:        fmt.Errorf("invalid admin secret"),
+		}
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		keys := []string{}
+		for _, bch := range targets {
+			for _, key := range bch.fileWhitelist.list() {
+				if !slices.Contains(keys, key) {
+					keys = append(keys, key)
+				}
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		return json.NewEncoder(w).Encode(map[string][]string{"keys": keys})
+
+	case http.MethodPost, http.MethodDelete:
+		var req whitelistRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.PubKey == "" {
+			return caddy.APIError{
+				HTTPStatus: http.StatusBadRequest,
+				Err:        fmt.Errorf("expected a JSON body with pub_key"),
+			}
+		}
+		add := r.Method == http.MethodPost
+		for _, bch := range targets {
+			if _, err := bch.generateAddress(req.PubKey); add && err != nil {
+				return caddy.APIError{
+					HTTPStatus: http.StatusBadRequest,
+					Err:        fmt.Errorf("invalid public key: %v", err),
+				}
+			}
+			if !add && bch.staticWhitelisted(req.PubKey) {
+				return caddy.APIError{
+					HTTPStatus: http.StatusConflict,
+					Err:        fmt.Errorf("key is whitelisted in the config and cannot be removed at runtime"),
+				}
+			}
+		}
+		var changed []*BchAuth
+		var failed []string
+		for _, bch := range targets {
+			ok, err := bch.fileWhitelist.update(req.PubKey, add, bch.WhitelistFile)
+			if err != nil {
+				failed = append(failed, fmt.Sprintf("%s: %v", bch.WhitelistFile, err))
+				continue
+			}
+			if ok {
+				changed = append(changed, bch)
+			}
+		}
+		if len(failed) > 0 {
+			// Undo the handlers already changed, so that all keep the same keys
+			var stuck []string
+			for _, bch := range changed {
+				if _, err := bch.fileWhitelist.update(req.PubKey, !add, bch.WhitelistFile); err != nil {
+					stuck = append(stuck, fmt.Sprintf("%s: %v", bch.WhitelistFile, err))
+				}
+			}
+			err := fmt.Errorf("saving whitelist file failed for %s; the change was undone", strings.Join(failed, ", "))
+			if len(stuck) > 0 {
+				err = fmt.Errorf("saving whitelist file failed for %s; undoing the change also failed for %s",
+					strings.Join(failed, ", "), strings.Join(stuck, ", "))
+			}
+			return caddy.APIError{
+				HTTPStatus: http.StatusInternalServerError,
+				Err:        err,
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		return json.NewEncoder(w).Encode(map[string]interface{}{
+			"pub_key":     req.PubKey,
+			"whitelisted": add,
+		})
+
+	default:
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+}
+
+// Interface guards
+var (
+	_ caddy.AdminRouter = (*adminAPI)(nil)
+)
@@ -0,0 +1,175 @@
+package bchauth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Audit log defaults.
+const (
+	auditQueueSize     = 4096
+	auditBatchSize     = 100
+	auditFlushInterval = time.Second
+	auditFlushTimeout  = 5 * time.Second
+)
+
+// auditColumns are the columns written per access decision, in the order
+// of the auditRecord fields.
+const auditColumns = "ts, pub_key, address, result, active_days, client_ip, request_path, request_method"
+
+// auditRecord is one row of audit_log_table.
+type auditRecord struct {
+	ts         time.Time
+	pubKey     string
+	address    string
+	result     string
+	activeDays int
+	clientIP   string
+	path       string
+	method     string
+}
+
+// auditLog queues access decisions for a background writer, so requests
+// never wait for the insert.
+type auditLog struct {
+	table   string
+	queue   chan auditRecord
+	dropped atomic.Int64
+}
+
+// auditTableName returns audit_log_table, qualified with pg_schema unless
+// it names a schema itself.
+func (bch *BchAuth) auditTableName() string {
+	if bch.PGSchema != "" && !strings.Contains(bch.AuditLogTable, ".") {
+		return bch.PGSchema + "." + bch.AuditLogTable
+	}
+	return bch.AuditLogTable
+}
+
+// MigrateAuditTable creates audit_log_table in the write database of the
+// handler if it does not exist. See migrations/003_audit_log.sql.
+func (bch *BchAuth) MigrateAuditTable(ctx context.Context) error {
+	if bch.AuditLogTable == "" {
+		return errors.New("audit_log_table is not set")
+	}
+	if bch.WriteDB == nil {
+		return errors.New("audit_log_table requires a write database connection")
+	}
+	_, err := bch.WriteDB.ExecContext(ctx, fmt.Sprintf(`
+		CREATE TABLE IF NOT EXISTS %s (
+			id             BIGSERIAL PRIMARY KEY,
+			ts             TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+			pub_key        TEXT NOT NULL,
+			address        TEXT NOT NULL,
+			result         TEXT NOT NULL,
+			active_days    INT NOT NULL,
+			client_ip      TEXT NOT NULL,
+			request_path   TEXT NOT NULL,
+			request_method TEXT NOT NULL
+		)`, bch.auditTableName()))
+	return err
+}
+
+// auditAccess queues the decision described by reason for audit_log_table.
+// When the queue is full, the record is dropped and counted rather than
+// delaying the request.
+func (bch *BchAuth) auditAccess(r *http.Request, pubKey, address, reason string, activeDays int) {
+	if bch.audit == nil {
+		return
+	}
+	rec := auditRecord{
+		ts:         time.Now(),
+		pubKey:     pubKey,
+		address:    address,
+		result:     reason,
+		activeDays: activeDays,
+		clientIP:   bch.clientIP(r),
+		path:       r.URL.Path,
+		method:     r.Method,
+	}
+	select {
+	case bch.audit.queue <- rec:
+	default:
+		bch.audit.dropped.Add(1)
+	}
+}
+
+// writeAudit inserts queued records in batches of up to auditBatchSize, at
+// least every auditFlushInterval, until ctx is done. Records still queued
+// then are written before it returns.
+func (bch *BchAuth) writeAudit(ctx context.Context, logger *zap.Logger) {
+	ticker := time.NewTicker(auditFlushInterval)
+	defer ticker.Stop()
+	batch := make([]auditRecord, 0, auditBatchSize)
+	flush := func(ctx context.Context) {
+		if n := bch.audit.dropped.Swap(0); n > 0 {
+			logger.Warn("audit log queue full; records dropped", zap.Int64("dropped", n))
+		}
+		if len(batch) == 0 {
+			return
+		}
+		if err := bch.insertAudit(ctx, batch); err != nil {
+			logger.Error("failed to write audit log", zap.Int("records", len(batch)), zap.Error(err))
+		}
+		batch = batch[:0]
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			// Cleanup closes the database once this returns
+			flushCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), auditFlushTimeout)
+			defer cancel()
+			for {
+				select {
+				case rec := <-bch.audit.queue:
+					batch = append(batch, rec)
+					if len(batch) == auditBatchSize {
+						flush(flushCtx)
+					}
+				default:
+					flush(flushCtx)
+					return
+				}
+			}
+		case rec := <-bch.audit.queue:
+			batch = append(batch, rec)
+			if len(batch) == auditBatchSize {
+				flush(ctx)
+			}
+		case <-ticker.C:
+			flush(ctx)
+		}
+	}
+}
+
+// insertAudit writes batch with a single multi-row INSERT.
+func (bch *BchAuth) insertAudit(ctx context.Context, batch []auditRecord) error {
+	const perRow = 8
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "INSERT INTO %s (%s) VALUES ", bch.audit.table, auditColumns)
+	args := make([]interface{}, 0, len(batch)*perRow)
+	for i, rec := range batch {
+		if i > 0 {
+			sb.WriteString(", ")
+		}
+		sb.WriteByte('(')
+		for j := 1; j <= perRow; j++ {
+			if j > 1 {
+				sb.WriteString(", ")
+			}
+			fmt.Fprintf(&sb, "$%d", i*perRow+j)
+		}
+		sb.WriteByte(')')
+		args = append(args, rec.ts, rec.pubKey, rec.address, rec.result, rec.activeDays, rec.clientIP, rec.path, rec.method)
+	}
+	_, err := bch.WriteDB.ExecContext(ctx, sb.String(), args...)
+	return err
+}
@@ -1,21 +1,31 @@
 package bchauth
 
+//go:generate go run gendocs.go
+
 import (
+	"context"
 	"database/sql"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"net"
 	"net/http"
+	"net/netip"
+	"net/url"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
 	"github.com/core-coin/go-core/v2/common"
-	"github.com/core-coin/go-core/v2/crypto"
 	"github.com/go-redis/redis/v8"
-	"golang.org/x/net/context"
+	lru "github.com/hashicorp/golang-lru/v2"
+	"go.uber.org/zap"
+	"golang.org/x/sync/singleflight"
 
 	_ "github.com/lib/pq" // PostgreSQL driver
 )
@@ -24,16 +34,156 @@ func init() {
 	caddy.RegisterModule(BchAuth{})
 }
 
+// Default PostgreSQL connection pool settings.
+const (
+	defaultPGMaxOpenConns    = 25
+	defaultPGMaxIdleConns    = 5
+	defaultPGConnMaxLifetime = 5 * time.Minute
+)
+
+// defaultProvisionTimeout bounds the database and Redis pings at startup
+// when provision_timeout is not set.
+const defaultProvisionTimeout = 10 * time.Second
+
+// defaultQueryTimeout bounds the Redis and database work of a request when
+// query_timeout is not set.
+const defaultQueryTimeout = 5 * time.Second
+
+// defaultAddressCacheSize bounds the in-memory cache of derived addresses
+// when address_cache_size is not set.
+const defaultAddressCacheSize = 10000
+
+// defaultCacheNamespace prefixes Redis keys when cache_namespace is not set.
+const defaultCacheNamespace = "bchauth"
+
+// defaultMaxServiceDays caps the service period when max_service_days is
+// not set, so a huge payment cannot create a near-permanent cache entry.
+const defaultMaxServiceDays = 365
+
+// defaultNegativeCacheTTL is how long a denial is cached when
+// negative_cache_ttl is not set.
+const defaultNegativeCacheTTL = 60 * time.Second
+
 type BchAuth struct {
-	DB              *sql.DB
-	RedisClient     *redis.Client
-	DestWallet      string   `json:"dest_wallet"`
-	MinFundsCTN     float64  `json:"funds_ctn"` // CTN amount required for 1 day of access
-	PGConnString    string   `json:"pg_conn_string"`
-	ConfiguredTable string   `json:"configured_table"` // Table name for transactions
-	RedisAddr       string   `json:"redis_addr"`       // Redis address
-	Whitelist       []string `json:"whitelist"`        // Public key whitelist
-	NetworkId       int64    `json:"network_id"`       // Network ID for blockchain addresses
+	// Connections opened by Provision, or supplied to
+	// NewBchAuthWithClients. They are not part of the JSON config.
+	DB          DBClient    `json:"-"`
+	ReplicaDB   DBClient    `json:"-"` // Read replica for the access query, if configured
+	WriteDB     DBClient    `json:"-"` // Connection for the tables bchauth writes; DB unless pg_write_conn_string is set
+	RedisClient CacheClient `json:"-"`
+
+	// Wallets that receive service payments; a payment to any of them
+	// counts. DestWallet is the older single-wallet form and is merged into
+	// DestWallets.
+	DestWallets []string `json:"dest_wallets,omitempty" caddyfile:"dest_wallet <wallet>..."`
+	DestWallet  string   `json:"dest_wallet,omitempty" caddyfile:"-"`
+
+	MinFundsCTN     float64  `json:"funds_ctn"`                  // CTN amount required for 1 day of access
+	PGConnString    string   `json:"pg_conn_string"`             // Database connection string
+	ConfiguredTable string   `json:"configured_table,omitempty"` // Table name for transactions; superseded by pg_table
+	RedisAddr       string   `json:"redis_addr"`                 // Redis address, or comma-separated seed list in sentinel and cluster mode
+	Whitelist       []string `json:"whitelist,omitempty"`        // Public key whitelist
+	NetworkId       int64    `json:"network_id,omitempty"`       // Network ID for blockchain addresses
+
+	DBDriver          string         `json:"db_driver,omitempty"`            // Database driver: postgres (default), mysql or sqlite3
+	ProvisionTimeout  caddy.Duration `json:"provision_timeout,omitempty"`    // Deadline of the database and Redis pings at startup (default 10s)
+	QueryTimeout      caddy.Duration `json:"query_timeout,omitempty"`        // Deadline of the cache lookups and access query of a request (default 5s)
+	PGMaxOpenConns    int            `json:"pg_max_open_conns,omitempty"`    // Maximum open PostgreSQL connections (default 25)
+	PGMaxIdleConns    int            `json:"pg_max_idle_conns,omitempty"`    // Maximum idle PostgreSQL connections (default 5)
+	PGConnMaxLifetime caddy.Duration `json:"pg_conn_max_lifetime,omitempty"` // Maximum lifetime of a PostgreSQL connection (default 5m)
+	PGSchema          string         `json:"pg_schema,omitempty"`            // Schema of the transactions table (default public)
+	PGTable           string         `json:"pg_table,omitempty"`             // Transactions table (default configured_table, then transactions)
+
+	PGReplicaConnString string `json:"pg_replica_conn_string,omitempty"` // Read replica that runs the access query, with the primary as fallback
+	PGReplicaPoolSize   int    `json:"pg_replica_pool_size,omitempty"`   // Maximum open replica connections (default pg_max_open_conns)
+	PGWriteConnString   string `json:"pg_write_conn_string,omitempty"`   // Writable PostgreSQL database for bchauth's own tables (default pg_conn_string)
+
+	RedisMode           string `json:"redis_mode,omitempty"`            // Redis deployment: single (default), sentinel or cluster
+	RedisSentinelMaster string `json:"redis_sentinel_master,omitempty"` // Master name in sentinel mode
+	RedisPassword       string `json:"redis_password,omitempty"`        // Redis password; may be a placeholder such as {env.REDIS_PASSWORD}
+	RedisTLSCert        string `json:"redis_tls_cert,omitempty"`        // Client certificate for TLS connections to Redis
+	RedisTLSKey         string `json:"redis_tls_key,omitempty"`         // Private key of redis_tls_cert
+	RedisTLSCA          string `json:"redis_tls_ca,omitempty"`          // CA bundle used to verify the Redis server
+	OptionalRedis       bool   `json:"optional_redis,omitempty"`        // Run without redis_addr, or start while Redis is down, querying the database instead
+
+	ExposeRemainingDays bool `json:"expose_remaining_days,omitempty"` // Set X-Service-Days-Remaining on authorized requests
+
+	Routes []RoutePrice `json:"routes,omitempty"` // Per-path price overrides: routes { route <prefix> <funds_ctn> }
+	Tiers  []Tier       `json:"tiers,omitempty"`  // Named daily rates replacing funds_ctn: tiers { <name> <funds_ctn> }
+
+	RequireSignature bool           `json:"require_signature,omitempty"` // Require an Ed448 X-Signature over "METHOD URI X-Timestamp"
+	SignatureMaxAge  caddy.Duration `json:"signature_max_age,omitempty"` // Maximum age of X-Timestamp (default 60s)
+
+	DBRetryAttempts *int           `json:"db_retry_attempts,omitempty"` // Retries of a failed database or Redis call (default 3; 0 disables)
+	DBRetryBackoff  caddy.Duration `json:"db_retry_backoff,omitempty"`  // Wait before the first retry, doubled for each further one (default 100ms)
+
+	CacheNamespace   string         `json:"cache_namespace,omitempty"`    // Prefix of Redis keys, so instances can share a server (default bchauth)
+	NegativeCacheTTL caddy.Duration `json:"negative_cache_ttl,omitempty"` // How long a denied key is answered from Redis (default 60s)
+	GracePeriod      caddy.Duration `json:"grace_period,omitempty"`       // How long access continues after the service ends (default 0)
+
+	MetricsEnabled *bool `json:"metrics_enabled,omitempty"` // Record Prometheus metrics (default true)
+
+	AdminPath   string `json:"admin_path,omitempty"`   // Path prefix of the status endpoint, e.g. /_bchauth
+	AdminSecret string `json:"admin_secret,omitempty"` // Value required in X-Admin-Secret for admin_path
+
+	WhitelistEntries []WhitelistEntry `json:"whitelist_entries,omitempty" caddyfile:"whitelist_entry <pubkey> [<rfc3339_expiry>]"` // Whitelisted key, optionally until an expiry time
+
+	WhitelistFile           string         `json:"whitelist_file,omitempty"`            // File with one whitelisted public key per line
+	WhitelistReloadInterval caddy.Duration `json:"whitelist_reload_interval,omitempty"` // How often whitelist_file is re-read (default 60s)
+
+	PubKeyHeader string   `json:"pubkey_header,omitempty"` // Header carrying the public key (default X-Pub-Key); Bearer is stripped from Authorization
+	PubKeyCookie string   `json:"pubkey_cookie,omitempty"` // Cookie holding the URL-safe base64 public key when the header is absent
+	PubKeySource []string `json:"pubkey_source,omitempty"` // Order in which the public key is looked up (default header cookie query)
+
+	PubKeyQueryParam string `json:"pubkey_query_param,omitempty"` // Query parameter holding the public key, removed before the request is passed on
+
+	CacheWarmupInterval   caddy.Duration `json:"cache_warmup_interval,omitempty"`    // How often near-expiry cache entries are refreshed (default disabled)
+	CacheWarmupLookahead  caddy.Duration `json:"cache_warmup_lookahead,omitempty"`   // Refresh entries expiring within this window (default 1h)
+	CacheWarmupQueryLimit int            `json:"cache_warmup_query_limit,omitempty"` // Maximum entries refreshed per cycle (default 1000)
+
+	KeyType          string `json:"key_type,omitempty"`           // Public key algorithm: ed448 (default), ed25519 or secp256k1
+	AddressCacheSize int    `json:"address_cache_size,omitempty"` // Derived addresses kept in memory (default 10000)
+	PubKeyEncoding   string `json:"pubkey_encoding,omitempty"`    // Encoding of X-Pub-Key: hex (default), base58 or base64
+
+	TrustedProxies []string `json:"trusted_proxies,omitempty"` // CIDR ranges of proxies whose X-Forwarded-For names the client
+
+	ErrorFormat string `json:"error_format,omitempty"` // Body of error responses: text (default) or json
+	DryRun      bool   `json:"dry_run,omitempty"`      // Decide and log as usual, but pass every request on
+
+	RateLimitRPS   float64        `json:"rate_limit_rps,omitempty"`   // Requests per second allowed per public key; 0 disables rate limiting
+	RateLimitBurst int            `json:"rate_limit_burst,omitempty"` // Requests a key may send at once (default rate_limit_rps, at least 1)
+	RateLimitTTL   caddy.Duration `json:"rate_limit_ttl,omitempty"`   // How long an idle key keeps its limiter (default 10m)
+
+	MaxServiceDays int            `json:"max_service_days,omitempty"` // Upper bound on cached service days (default 365)
+	MaxTxAge       caddy.Duration `json:"max_tx_age,omitempty"`       // Ignore payments older than this (default unlimited)
+	BillingUnit    string         `json:"billing_unit,omitempty"`     // Period bought by funds_ctn: day (default) or hour
+
+	EnableLinkedAddresses     bool `json:"enable_linked_addresses,omitempty"`     // Count payments from addresses in bchauth_linked_addresses
+	MatchSender               bool `json:"match_sender,omitempty"`                // Count payments from the key's address (from_addr) to dest_wallet instead of those to it
+	AccumulatePartialPayments bool `json:"accumulate_partial_payments,omitempty"` // Carry value beyond whole days over to later payments
+
+	WebhookURL          string         `json:"webhook_url,omitempty"`           // URL that is POSTed when a service is about to expire
+	WebhookNotifyBefore caddy.Duration `json:"webhook_notify_before,omitempty"` // How long before expiry the webhook is sent (default 72h)
+	WebhookSecret       string         `json:"webhook_secret,omitempty"`        // Key of the X-BchAuth-Signature HMAC of webhook bodies
+
+	AuditLogTable string `json:"audit_log_table,omitempty"` // PostgreSQL table that records every access decision (default disabled)
+
+	fileWhitelist  *fileWhitelist
+	audit          *auditLog
+	trustedProxies []netip.Prefix
+	keyScheme      keyScheme
+	addrCache      *lru.Cache[string, string] // public key -> address
+	inflight       *singleflight.Group
+	cancel         context.CancelFunc
+	logger         *zap.Logger
+	limiters       *sync.Map // rateLimitKey -> *keyLimiter
+	background     *sync.WaitGroup
+
+	// AccessCheckerRaw selects a custom access-check backend. When it is
+	// omitted, a PostgreSQL checker using PGConnString and ConfiguredTable
+	// is used.
+	AccessCheckerRaw json.RawMessage `json:"access_checker,omitempty" caddyfile:"-" caddy:"namespace=http.handlers.bchauth.access_checkers inline_key=driver"`
+	AccessChecker    AccessChecker   `json:"-"`
 }
 
 // CaddyModule returns the Caddy module information.
@@ -44,142 +194,752 @@ func (BchAuth) CaddyModule() caddy.ModuleInfo {
 	}
 }
 
-// Provision initializes the PostgreSQL and Redis connections.
+// Provision initializes the access checker and the Redis connection.
 func (bch *BchAuth) Provision(ctx caddy.Context) error {
 	var err error
+	bch.logger = ctx.Logger(bch)
+	// Expanded only here, so that secrets are not written into the adapted
+	// JSON config
+	bch.expandEnv()
+
+	if bch.MaxServiceDays == 0 {
+		bch.MaxServiceDays = defaultMaxServiceDays
+	}
+	if bch.CacheNamespace == "" {
+		bch.CacheNamespace = defaultCacheNamespace
+	}
+	if bch.ProvisionTimeout == 0 {
+		bch.ProvisionTimeout = caddy.Duration(defaultProvisionTimeout)
+	}
+	if bch.QueryTimeout == 0 {
+		bch.QueryTimeout = caddy.Duration(defaultQueryTimeout)
+	}
+	if bch.DBRetryBackoff == 0 {
+		bch.DBRetryBackoff = caddy.Duration(defaultDBRetryBackoff)
+	}
+	if bch.DestWallet != "" && !slices.Contains(bch.DestWallets, bch.DestWallet) {
+		bch.DestWallets = append([]string{bch.DestWallet}, bch.DestWallets...)
+	}
+
+	if bch.AccessCheckerRaw != nil {
+		mod, err := ctx.LoadModule(bch, "AccessCheckerRaw")
+		if err != nil {
+			return fmt.Errorf("loading access checker: %v", err)
+		}
+		bch.AccessChecker = mod.(AccessChecker)
+	} else {
+		// Initialize the database connection
+		driverName, err := sqlDriverName(bch.DBDriver)
+		if err != nil {
+			return err
+		}
+		db, err := sql.Open(driverName, bch.PGConnString)
+		if err != nil {
+			return fmt.Errorf("failed to connect to the database: %v", err)
+		}
+
+		if bch.PGMaxOpenConns == 0 {
+			bch.PGMaxOpenConns = defaultPGMaxOpenConns
+		}
+		if bch.PGMaxIdleConns == 0 {
+			bch.PGMaxIdleConns = defaultPGMaxIdleConns
+		}
+		if bch.PGConnMaxLifetime == 0 {
+			bch.PGConnMaxLifetime = caddy.Duration(defaultPGConnMaxLifetime)
+		}
+		db.SetMaxOpenConns(bch.PGMaxOpenConns)
+		db.SetMaxIdleConns(bch.PGMaxIdleConns)
+		db.SetConnMaxLifetime(time.Duration(bch.PGConnMaxLifetime))
+		bch.DB = db
+
+		// Test the connection
+		pingCtx, cancel := context.WithTimeout(ctx, time.Duration(bch.ProvisionTimeout))
+		err = bch.DB.PingContext(pingCtx)
+		cancel()
+		if err != nil {
+			return fmt.Errorf("failed to ping the database: %v", err)
+		}
+
+		if bch.PGReplicaConnString != "" {
+			replica, err := sql.Open(driverName, bch.PGReplicaConnString)
+			if err != nil {
+				return fmt.Errorf("failed to connect to the replica database: %v", err)
+			}
+			if bch.PGReplicaPoolSize == 0 {
+				bch.PGReplicaPoolSize = bch.PGMaxOpenConns
+			}
+			replica.SetMaxOpenConns(bch.PGReplicaPoolSize)
+			replica.SetMaxIdleConns(min(bch.PGMaxIdleConns, bch.PGReplicaPoolSize))
+			replica.SetConnMaxLifetime(time.Duration(bch.PGConnMaxLifetime))
+			bch.ReplicaDB = replica
+
+			// Queries fall back to the primary, so a replica that is down
+			// does not stop the server from starting
+			pingCtx, cancel := context.WithTimeout(ctx, time.Duration(bch.ProvisionTimeout))
+			err = bch.ReplicaDB.PingContext(pingCtx)
+			cancel()
+			if err != nil {
+				bch.logger.Warn("failed to ping the replica database", zap.Error(err))
+			}
+		}
+
+		if bch.PGTable == "" {
+			bch.PGTable = bch.ConfiguredTable
+		}
+		checker := &PostgreSQLAccessChecker{
+			DB:              bch.DB,
+			ReplicaDB:       bch.ReplicaDB,
+			DBDriver:        bch.DBDriver,
+			Schema:          bch.PGSchema,
+			Table:           bch.PGTable,
+			MaxServiceDays:  bch.MaxServiceDays,
+			MaxTxAge:        bch.MaxTxAge,
+			LinkedAddresses: bch.EnableLinkedAddresses,
+			MatchSender:     bch.MatchSender,
+			BillingUnit:     bch.BillingUnit,
+
+			AccumulatePartialPayments: bch.AccumulatePartialPayments,
+		}
+		if err := checker.Provision(ctx); err != nil {
+			return err
+		}
+		bch.AccessChecker = checker
+	}
 
-	// Initialize PostgreSQL connection
-	bch.DB, err = sql.Open("postgres", bch.PGConnString)
+	if len(bch.DestWallets) > 0 && !bch.MatchSender && bch.AccessCheckerRaw == nil {
+		bch.logger.Warn("dest_wallet is ignored without match_sender; payments to the key's address count, whatever wallet sent them",
+			zap.Strings("dest_wallets", bch.DestWallets))
+	}
+	if err := validatePubKeySource(bch.PubKeySource); err != nil {
+		return err
+	}
+	bch.trustedProxies, err = parseTrustedProxies(bch.TrustedProxies)
+	if err != nil {
+		return err
+	}
+	if bch.AdminPath != "" && bch.AdminSecret == "" {
+		return errors.New("admin_secret is required when admin_path is set")
+	}
+	if bch.PubKeyQueryParam != "" {
+		bch.logger.Warn("pubkey_query_param is enabled; public keys sent in the URL appear in access logs",
+			zap.String("param", bch.PubKeyQueryParam))
+	}
+
+	if bch.NegativeCacheTTL == 0 {
+		bch.NegativeCacheTTL = caddy.Duration(defaultNegativeCacheTTL)
+	}
+
+	bch.inflight = new(singleflight.Group)
+	bch.sortTiers()
+	prefix, err := bch.NetworkIDPrefix()
+	if err != nil {
+		return err
+	}
+	if bch.KeyType == keyTypeSecp256k1 && bch.NetworkId == 0 {
+		// network_id 0 selects plain Ethereum addresses
+		prefix = nil
+	}
+	bch.keyScheme, err = newKeyScheme(bch.KeyType, prefix)
+	if err != nil {
+		return err
+	}
+	if bch.AddressCacheSize == 0 {
+		bch.AddressCacheSize = defaultAddressCacheSize
+	}
+	bch.addrCache, err = lru.New[string, string](bch.AddressCacheSize)
 	if err != nil {
-		return fmt.Errorf("failed to connect to PostgreSQL: %v", err)
+		return fmt.Errorf("invalid address_cache_size: %v", err)
 	}
 
-	// Test the connection
-	if err := bch.DB.Ping(); err != nil {
-		return fmt.Errorf("failed to ping PostgreSQL: %v", err)
+	// Background tasks stop when the module is cleaned up
+	var bgCtx context.Context
+	bgCtx, bch.cancel = context.WithCancel(ctx)
+	bch.background = new(sync.WaitGroup)
+
+	// Keys added through the admin API live here even without a file
+	bch.fileWhitelist = &fileWhitelist{encoding: bch.PubKeyEncoding}
+	if bch.WhitelistFile != "" {
+		if err := bch.fileWhitelist.load(bch.WhitelistFile); err != nil {
+			return fmt.Errorf("failed to load whitelist file: %v", err)
+		}
+		if bch.WhitelistReloadInterval == 0 {
+			bch.WhitelistReloadInterval = caddy.Duration(defaultWhitelistReloadInterval)
+		}
+		bch.goBackground(func() { bch.reloadWhitelist(bgCtx, time.Duration(bch.WhitelistReloadInterval), bch.logger) })
+	}
+
+	if bch.RateLimitRPS > 0 {
+		bch.RateLimitBurst = bch.rateLimitBurst()
+		if bch.RateLimitTTL == 0 {
+			bch.RateLimitTTL = caddy.Duration(defaultRateLimitTTL)
+		}
+		bch.limiters = new(sync.Map)
+		bch.goBackground(func() { bch.purgeLimiters(bgCtx, time.Duration(bch.RateLimitTTL)) })
+	}
+
+	if bch.WebhookURL != "" {
+		if bch.DB == nil || (bch.DBDriver != "" && bch.DBDriver != dbDriverPostgres) {
+			return errors.New("webhook_url requires the built-in PostgreSQL access checker")
+		}
+		if bch.WebhookNotifyBefore == 0 {
+			bch.WebhookNotifyBefore = caddy.Duration(defaultWebhookNotifyBefore)
+		}
+		if err := bch.openWriteDB(ctx); err != nil {
+			return err
+		}
+	}
+
+	if bch.AuditLogTable != "" {
+		if bch.DB == nil || (bch.DBDriver != "" && bch.DBDriver != dbDriverPostgres) {
+			return errors.New("audit_log_table requires the built-in PostgreSQL access checker")
+		}
+		if strings.ContainsAny(bch.AuditLogTable, "; \t\r\n") {
+			return fmt.Errorf("invalid audit_log_table %q", bch.AuditLogTable)
+		}
+		if err := bch.openWriteDB(ctx); err != nil {
+			return err
+		}
+		bch.audit = &auditLog{table: bch.auditTableName(), queue: make(chan auditRecord, auditQueueSize)}
+	}
+
+	if bch.CacheWarmupInterval > 0 {
+		if bch.CacheWarmupLookahead == 0 {
+			bch.CacheWarmupLookahead = caddy.Duration(defaultCacheWarmupLookahead)
+		}
+		if bch.CacheWarmupQueryLimit == 0 {
+			bch.CacheWarmupQueryLimit = defaultCacheWarmupQueryLimit
+		}
 	}
 
 	// Initialize Redis connection
-	bch.RedisClient = redis.NewClient(&redis.Options{
-		Addr: bch.RedisAddr,
-	})
-	if _, err := bch.RedisClient.Ping(ctx).Result(); err != nil {
-		return fmt.Errorf("failed to connect to Redis: %v", err)
+	if bch.RedisAddr != "" {
+		bch.RedisClient, err = bch.newRedisClient()
+		if err != nil {
+			return err
+		}
+		pingCtx, cancel := context.WithTimeout(ctx, time.Duration(bch.ProvisionTimeout))
+		_, err = bch.RedisClient.Ping(pingCtx).Result()
+		cancel()
+		if err != nil && !bch.OptionalRedis {
+			return fmt.Errorf("failed to connect to Redis: %v", err)
+		}
+		if err != nil {
+			// The client reconnects on its own once Redis is back
+			bch.logger.Warn("failed to connect to Redis; querying the database until it is reachable", zap.Error(err))
+		}
+	} else {
+		bch.logger.Info("no redis_addr; every request queries the database")
+	}
+
+	if cacheConflict(bch) {
+		bch.logger.Warn("another bchauth handler with other payment settings uses the same cache_namespace; "+
+			"access cached by one is honored by the other", zap.String("cache_namespace", bch.CacheNamespace))
+	}
+	registerInstance(bch)
+
+	if bch.CacheWarmupInterval > 0 {
+		bch.goBackground(func() { bch.warmCache(bgCtx, time.Duration(bch.CacheWarmupInterval), bch.logger) })
+	}
+	if bch.WebhookURL != "" {
+		bch.goBackground(func() { bch.notifyExpiring(bgCtx, bch.logger) })
+	}
+	if bch.audit != nil {
+		bch.goBackground(func() { bch.writeAudit(bgCtx, bch.logger) })
 	}
 
 	return nil
 }
 
+// Validate checks that the configuration is consistent.
+func (bch *BchAuth) Validate() error {
+	// The built-in checker filters on the wallets only with match_sender;
+	// custom checkers are always given them
+	if len(bch.DestWallets) == 0 && (bch.MatchSender || bch.AccessCheckerRaw != nil) {
+		return errors.New("dest_wallet is required with match_sender or an access_checker")
+	}
+	for _, wallet := range bch.DestWallets {
+		if _, err := common.HexToAddress(wallet); err != nil {
+			return fmt.Errorf("invalid dest_wallet %q: %v", wallet, err)
+		}
+	}
+	if bch.MinFundsCTN <= 0 && len(bch.Tiers) == 0 {
+		return fmt.Errorf("funds_ctn must be positive, got %v", bch.MinFundsCTN)
+	}
+	for _, tier := range bch.Tiers {
+		if tier.Name == "" || tier.FundsCTN <= 0 {
+			return fmt.Errorf("tier %q must have a name and a positive funds_ctn", tier.Name)
+		}
+	}
+	for _, route := range bch.Routes {
+		if route.MinFundsCTN <= 0 {
+			return fmt.Errorf("funds_ctn of route %s must be positive, got %v", route.Prefix, route.MinFundsCTN)
+		}
+	}
+	if bch.RateLimitRPS < 0 || bch.RateLimitBurst < 0 {
+		return errors.New("rate_limit_rps and rate_limit_burst must not be negative")
+	}
+	if bch.GracePeriod < 0 {
+		return errors.New("grace_period must not be negative")
+	}
+	if err := bch.ValidateNetworkId(); err != nil {
+		return err
+	}
+
+	for name, value := range map[string]string{"pg_conn_string": bch.PGConnString, "pg_replica_conn_string": bch.PGReplicaConnString, "pg_write_conn_string": bch.PGWriteConnString, "redis_addr": bch.RedisAddr, "redis_password": bch.RedisPassword} {
+		if unexpandedEnv(value) {
+			return fmt.Errorf("%s references an unset environment variable", name)
+		}
+	}
+
+	addrs := splitAddrs(bch.RedisAddr)
+	if len(addrs) == 0 && !bch.OptionalRedis {
+		return errors.New("redis_addr is required unless optional_redis is set")
+	}
+	if len(addrs) == 0 && bch.CacheWarmupInterval > 0 {
+		return errors.New("cache_warmup_interval requires redis_addr")
+	}
+	for _, addr := range addrs {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return fmt.Errorf("invalid redis_addr %q: %v", addr, err)
+		}
+	}
+
+	if bch.AccessCheckerRaw == nil && bch.PGConnString == "" {
+		return errors.New("pg_conn_string is required unless an access_checker is configured")
+	}
+
+	switch bch.PubKeyEncoding {
+	case "", pubKeyEncodingHex, pubKeyEncodingBase58, pubKeyEncodingBase64:
+	default:
+		return fmt.Errorf("unknown pubkey_encoding %q: must be hex, base58 or base64", bch.PubKeyEncoding)
+	}
+
+	if bch.WebhookURL != "" {
+		u, err := url.Parse(bch.WebhookURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid webhook_url %q: must be an http or https URL", bch.WebhookURL)
+		}
+	}
+
+	if err := validateBillingUnit(bch.BillingUnit); err != nil {
+		return err
+	}
+
+	switch bch.ErrorFormat {
+	case "", errorFormatText, errorFormatJSON:
+	default:
+		return fmt.Errorf("unknown error_format %q: must be text or json", bch.ErrorFormat)
+	}
+	return nil
+}
+
 // ServeHTTP verifies access based on blockchain transactions or whitelist.
 func (bch *BchAuth) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
-	ctx := context.Background()
-	pubKey := r.Header.Get("X-Pub-Key")
+	if bch.isAdminRequest(r) {
+		return bch.serveAdmin(w, r)
+	}
+
+	// Bound the cache and database work; next still gets the request as is
+	ctx, cancel := context.WithTimeout(r.Context(), time.Duration(bch.QueryTimeout))
+	defer cancel()
+	result := resultDenied
+	defer func() { bch.recordRequest(result) }()
+
+	pubKey := bch.pubKeyFromRequest(r)
 	if pubKey == "" {
-		http.Error(w, "Missing X-Pub-Key", http.StatusForbidden)
-		return nil
+		bch.logger.Warn("access denied", bch.accessFields(r, "", "", "missing_pub_key", 0, false)...)
+		bch.auditAccess(r, "", "", "missing_pub_key", 0)
+		return bch.deny(w, r, next, "Missing "+bch.pubKeyHeader(), http.StatusForbidden)
+	}
+
+	// Throttle a key before it can cost a signature check or a query
+	if !bch.allowRequest(r, pubKey) {
+		bch.logger.Warn("access denied", bch.accessFields(r, pubKey, "", "rate_limited", 0, false)...)
+		bch.auditAccess(r, pubKey, "", "rate_limited", 0)
+		return bch.deny(w, r, next, "Too Many Requests", http.StatusTooManyRequests)
+	}
+
+	// Prove possession of the key before trusting it
+	if bch.RequireSignature {
+		if err := bch.verifySignature(r, pubKey); err != nil {
+			bch.logger.Warn("access denied", append(bch.accessFields(r, pubKey, "", "invalid_signature", 0, false), zap.Error(err))...)
+			bch.auditAccess(r, pubKey, "", "invalid_signature", 0)
+			return bch.deny(w, r, next, "Invalid Signature", http.StatusForbidden)
+		}
 	}
 
 	// Check whitelist
 	if bch.isWhitelisted(pubKey) {
-		return next.ServeHTTP(w, r)
+		result = resultWhitelisted
+		bch.logger.Info("access allowed", bch.accessFields(r, pubKey, "", "whitelisted", -1, false)...)
+		bch.auditAccess(r, pubKey, "", "whitelisted", -1)
+		bch.setRemainingDays(w, -1)
+		return bch.allow(w, r, next)
 	}
 
-	// Check Redis cache
-	cacheKey := "access:" + pubKey
-	expiry, err := bch.RedisClient.Get(ctx, cacheKey).Result()
-	expiryInt, pasrseErr := strconv.ParseInt(expiry, 10, 64)
-	if pasrseErr != nil {
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-		return nil
+	// Paths with their own price are cached separately
+	minFunds := bch.MinFundsCTN
+	cacheID := pubKey
+	route := bch.routeFor(r.URL.Path)
+	if route != nil {
+		minFunds = route.MinFundsCTN
+		cacheID = route.Prefix + ":" + pubKey
 	}
-	if err == nil && time.Now().Before(time.Unix(0, 0).Add(time.Second*time.Duration(expiryInt))) {
-		return next.ServeHTTP(w, r)
+	cacheKey := bch.redisKey("access", cacheID)
+	denyKey := bch.redisKey("deny", cacheID)
+	graceKey := bch.redisKey("grace", cacheID)
+
+	// Check Redis cache. Without Redis, every request queries the database.
+	redisOK := bch.RedisClient != nil
+	if redisOK {
+		start := time.Now()
+		var expiry string
+		err := bch.withCacheRetry(ctx, func() (err error) {
+			expiry, err = bch.RedisClient.Get(ctx, cacheKey).Result()
+			return err
+		})
+		bch.observeRedisOp("get", start)
+		redisOK = err == nil || errors.Is(err, redis.Nil)
+		switch {
+		case err == nil:
+			// The cached value holds the time at which access expires. An
+			// unparsable or stale entry is treated as a cache miss.
+			expiresAt, tier, parseErr := parseCacheValue(expiry)
+			if parseErr == nil && time.Now().Before(expiresAt) {
+				result = resultAllowed
+				bch.recordCacheHit()
+				days := remainingDays(expiresAt)
+				bch.logger.Info("access allowed", bch.accessFields(r, pubKey, "", "cache_hit", days, true)...)
+				bch.auditAccess(r, pubKey, "", "cache_hit", days)
+				bch.setRemainingDays(w, days)
+				setTier(w, tier)
+				return bch.allow(w, r, next)
+			}
+		case errors.Is(err, redis.Nil):
+			// Cache miss, fall through to the blockchain check
+		default:
+			// Redis is unavailable; the blockchain check below still decides
+			// access, so the cache is bypassed rather than failing the request.
+			bch.logger.Error("redis cache lookup failed", append(bch.accessFields(r, pubKey, "", "redis_error", 0, false), zap.Error(err))...)
+		}
 	}
 
-	// Generate wallet address using Ed448
+	// A key in its grace period is answered without querying the database
+	if redisOK && bch.GracePeriod > 0 {
+		start := time.Now()
+		grace, err := bch.RedisClient.Get(ctx, graceKey).Result()
+		bch.observeRedisOp("get", start)
+		if err != nil && !errors.Is(err, redis.Nil) {
+			bch.logger.Error("redis grace lookup failed", append(bch.accessFields(r, pubKey, "", "redis_error", 0, false), zap.Error(err))...)
+		}
+		if graceUntil, tier, parseErr := parseCacheValue(grace); err == nil && parseErr == nil && time.Now().Before(graceUntil) {
+			result = resultAllowed
+			bch.recordCacheHit()
+			bch.logger.Info("access allowed", bch.accessFields(r, pubKey, "", "grace_period", 0, true)...)
+			bch.auditAccess(r, pubKey, "", "grace_period", 0)
+			bch.setGrace(w, graceUntil)
+			setTier(w, tier)
+			return bch.allow(w, r, next)
+		}
+	}
+
+	// A recent denial is answered without querying the database
+	if redisOK {
+		start := time.Now()
+		denied, err := bch.RedisClient.Exists(ctx, denyKey).Result()
+		bch.observeRedisOp("exists", start)
+		if err != nil {
+			bch.logger.Error("redis denial lookup failed", append(bch.accessFields(r, pubKey, "", "redis_error", 0, false), zap.Error(err))...)
+		}
+		if denied > 0 {
+			bch.logger.Warn("access denied", bch.accessFields(r, pubKey, "", "cached_denial", 0, true)...)
+			bch.auditAccess(r, pubKey, "", "cached_denial", 0)
+			return bch.deny(w, r, next, "Service Expired", http.StatusForbidden)
+		}
+	}
+
+	// Derive the wallet address from the public key
 	address, err := bch.generateAddress(pubKey)
 	if err != nil {
-		http.Error(w, "Invalid Public Key", http.StatusForbidden)
-		return nil
+		bch.logger.Warn("access denied", append(bch.accessFields(r, pubKey, "", "invalid_public_key", 0, false), zap.Error(err))...)
+		bch.auditAccess(r, pubKey, "", "invalid_public_key", 0)
+		return bch.deny(w, r, next, "Invalid Public Key", http.StatusForbidden)
 	}
 
-	// Query PostgreSQL to calculate active service days
-	activeDays, err := bch.checkActiveService(address, bch.MinFundsCTN)
+	// Concurrent misses for the same key share one access check
+	endDate, tier, err := bch.resolveAccess(ctx, cacheID, address, minFunds, route == nil)
+	if errors.Is(err, context.DeadlineExceeded) {
+		result = resultError
+		bch.logger.Error("access check timed out", append(bch.accessFields(r, pubKey, address, "db_timeout", 0, false), zap.Error(err))...)
+		bch.auditAccess(r, pubKey, address, "db_timeout", 0)
+		if !bch.DryRun {
+			w.Header().Set("Retry-After", "1")
+		}
+		return bch.deny(w, r, next, "Gateway Timeout", http.StatusGatewayTimeout)
+	}
 	if err != nil {
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-		return nil
+		result = resultError
+		bch.logger.Error("access check failed", append(bch.accessFields(r, pubKey, address, "db_error", 0, false), zap.Error(err))...)
+		bch.auditAccess(r, pubKey, address, "db_error", 0)
+		return bch.deny(w, r, next, "Internal Server Error", http.StatusInternalServerError)
 	}
-
-	if activeDays <= 0 {
-		http.Error(w, "Service Expired", http.StatusForbidden)
-		return nil
+	if !time.Now().Before(endDate) {
+		if graceUntil, ok := bch.graceUntil(endDate); ok {
+			result = resultAllowed
+			bch.logger.Info("access allowed", bch.accessFields(r, pubKey, address, "grace_period", 0, false)...)
+			bch.auditAccess(r, pubKey, address, "grace_period", 0)
+			bch.setGrace(w, graceUntil)
+			setTier(w, tier)
+			return bch.allow(w, r, next)
+		}
+		bch.logger.Warn("access denied", bch.accessFields(r, pubKey, address, "service_expired", 0, false)...)
+		bch.auditAccess(r, pubKey, address, "service_expired", 0)
+		return bch.deny(w, r, next, "Service Expired", http.StatusForbidden)
+	}
+	if route == nil {
+		bch.trackForWarmup(ctx, pubKey, address, endDate)
 	}
 
-	// Set Redis cache for remaining valid service days
-	cacheDuration := int64(activeDays) * 86400 // Convert days to seconds
-	bch.RedisClient.Set(ctx, cacheKey, cacheDuration, time.Duration(cacheDuration)*time.Second)
+	result = resultAllowed
+	days := remainingDays(endDate)
+	bch.logger.Info("access allowed", bch.accessFields(r, pubKey, address, "active", days, false)...)
+	bch.auditAccess(r, pubKey, address, "active", days)
+	bch.setRemainingDays(w, days)
+	setTier(w, tier)
+	return bch.allow(w, r, next)
+}
 
+// deny rejects r with msg and status. In dry_run mode the request is
+// passed on instead, marked as denied.
+func (bch *BchAuth) deny(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler, msg string, status int) error {
+	if bch.DryRun {
+		w.Header().Set("X-BchAuth-Dry-Run-Result", "denied")
+		bch.stripPubKeyQuery(r)
+		return next.ServeHTTP(w, r)
+	}
+	bch.writeError(w, msg, status)
+	return nil
+}
+
+// allow passes r on to next, marked as allowed in dry_run mode. The
+// pubkey_query_param credential is removed first.
+func (bch *BchAuth) allow(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
+	if bch.DryRun {
+		w.Header().Set("X-BchAuth-Dry-Run-Result", "allowed")
+	}
+	bch.stripPubKeyQuery(r)
 	return next.ServeHTTP(w, r)
 }
 
-// isWhitelisted checks if the public key is in the whitelist.
-func (bch *BchAuth) isWhitelisted(pubKey string) bool {
-	for _, whitelistedKey := range bch.Whitelist {
-		if strings.EqualFold(whitelistedKey, pubKey) {
-			return true
+// accessGrant is the outcome of an access check shared by concurrent
+// requests.
+type accessGrant struct {
+	endDate time.Time
+	tier    string
+}
+
+// resolveAccess queries the access checker for the end of the paid service
+// period of address and caches the outcome under cacheID. tiered selects
+// tier pricing where configured. Concurrent calls for the same cacheID
+// share a single query. It runs detached from the cancellation of
+// whichever request started it, bounded by a query_timeout of its own, and
+// so do the writes that record the outcome; only the waits between retries
+// end with that request. Every caller stops waiting when its own ctx is
+// done.
+func (bch *BchAuth) resolveAccess(ctx context.Context, cacheID, address string, minFunds float64, tiered bool) (time.Time, string, error) {
+	reqCtx := ctx
+	ctx = context.WithoutCancel(ctx)
+	ch := bch.inflight.DoChan(cacheID, func() (interface{}, error) {
+		queryCtx, cancel := context.WithTimeout(ctx, time.Duration(bch.QueryTimeout))
+		defer cancel()
+		start := time.Now()
+		var endDate time.Time
+		var tier string
+		err := bch.withRetry(reqCtx, func() (err error) {
+			endDate, tier, err = bch.checkAccess(queryCtx, address, minFunds, tiered)
+			return err
+		})
+		bch.observeDBQuery(start)
+		if err != nil {
+			if errors.Is(queryCtx.Err(), context.DeadlineExceeded) && !errors.Is(err, context.DeadlineExceeded) {
+				// Drivers report a cancelled query in their own words
+				err = fmt.Errorf("%w: %w", context.DeadlineExceeded, err)
+			}
+			return accessGrant{}, err
+		}
+
+		// Recording the outcome gets a deadline of its own, so a hanging
+		// database or Redis cannot hold the flight open
+		writeCtx, cancelWrite := context.WithTimeout(ctx, time.Duration(bch.QueryTimeout))
+		defer cancelWrite()
+		if bch.WebhookURL != "" && bch.WriteDB != nil && tiered && time.Now().Before(endDate) {
+			if err := bch.recordExpiry(writeCtx, address, endDate); err != nil {
+				bch.logger.Warn("failed to record service end", zap.String("address", address), zap.Error(err))
+			}
+		}
+		endDate = bch.capEndDate(endDate)
+
+		if bch.RedisClient == nil {
+			return accessGrant{endDate: endDate, tier: tier}, nil
 		}
+		start = time.Now()
+		setErr := bch.withCacheRetry(reqCtx, func() error {
+			if cacheDuration := time.Until(endDate); cacheDuration > 0 {
+				// Cache access until the on-chain service period ends
+				return bch.RedisClient.Set(writeCtx, bch.redisKey("access", cacheID), cacheValue(endDate, tier), cacheDuration).Err()
+			}
+			if graceUntil, ok := bch.graceUntil(endDate); ok {
+				return bch.RedisClient.Set(writeCtx, bch.redisKey("grace", cacheID), cacheValue(graceUntil, tier), time.Until(graceUntil)).Err()
+			}
+			// Only confirmed denials are cached, never database failures,
+			// so an outage cannot lock out paying users.
+			return bch.RedisClient.Set(writeCtx, bch.redisKey("deny", cacheID), 1, time.Duration(bch.NegativeCacheTTL)).Err()
+		})
+		bch.observeRedisOp("set", start)
+		if setErr != nil && !bch.OptionalRedis {
+			bch.logger.Error("failed to cache access check", zap.String("address", address), zap.Error(setErr))
+		}
+
+		return accessGrant{endDate: endDate, tier: tier}, nil
+	})
+	var res singleflight.Result
+	select {
+	case res = <-ch:
+	case <-reqCtx.Done():
+		return time.Time{}, "", reqCtx.Err()
+	}
+	if res.Err != nil {
+		return time.Time{}, "", res.Err
 	}
-	return false
+	grant := res.Val.(accessGrant)
+	return grant.endDate, grant.tier, nil
 }
 
-// checkActiveService queries the database for active service days based on the user's transactions.
-func (bch *BchAuth) checkActiveService(address string, minFunds float64) (int, error) {
-	query := fmt.Sprintf(`
-		WITH RECURSIVE service_periods AS (
-			SELECT
-				t.created_at AS start_date,
-				t.created_at + INTERVAL '1 day' * FLOOR(t.value::NUMERIC / $2) AS end_date,
-				FLOOR(t.value::NUMERIC / $2) AS service_days
-			FROM %s t
-			WHERE t.to_addr = $1
-
-			UNION ALL
-
-			SELECT
-				CASE
-					WHEN t.created_at > sp.end_date THEN t.created_at
-					ELSE sp.start_date
-				END AS start_date,
-				t.created_at + INTERVAL '1 day' * FLOOR(t.value::NUMERIC / $2) AS end_date,
-				sp.service_days + FLOOR(t.value::NUMERIC / $2) AS service_days
-			FROM %s t
-			JOIN service_periods sp
-				ON t.to_addr = $1
-			   AND t.created_at > sp.end_date
-		)
-		SELECT SUM(service_days)
-		FROM service_periods
-		WHERE start_date <= NOW() AND end_date >= NOW();
-	`, bch.ConfiguredTable, bch.ConfiguredTable)
-
-	var totalServiceDays int
-	err := bch.DB.QueryRow(query, address, minFunds).Scan(&totalServiceDays)
-	if err != nil {
-		return 0, err
+// Supported values of error_format.
+const (
+	errorFormatText = "text"
+	errorFormatJSON = "json"
+)
+
+// writeError replies with msg and status, as plain text or, when
+// error_format is json, as {"error":msg,"code":status}.
+func (bch *BchAuth) writeError(w http.ResponseWriter, msg string, status int) {
+	if bch.ErrorFormat != errorFormatJSON {
+		http.Error(w, msg, status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(struct {
+		Error string `json:"error"`
+		Code  int    `json:"code"`
+	}{msg, status})
+}
+
+// accessFields returns the structured log fields describing an access
+// decision. Only a prefix of the public key is logged.
+func (bch *BchAuth) accessFields(r *http.Request, pubKey, address, reason string, activeDays int, cacheHit bool) []zap.Field {
+	if len(pubKey) > 16 {
+		pubKey = pubKey[:16]
+	}
+	return []zap.Field{
+		zap.Bool("dry_run", bch.DryRun),
+		zap.String("pub_key", pubKey),
+		zap.String("address", address),
+		zap.String("reason", reason),
+		zap.Int("active_days", activeDays),
+		zap.Bool("cache_hit", cacheHit),
+		zap.String("request_path", r.URL.Path),
+		zap.String("client_ip", bch.clientIP(r)),
+	}
+}
+
+// graceUntil returns the end of the grace period after a service that
+// ended at endDate, and whether it is still running. A key that never paid
+// has no grace period.
+func (bch *BchAuth) graceUntil(endDate time.Time) (time.Time, bool) {
+	if bch.GracePeriod <= 0 || endDate.IsZero() {
+		return time.Time{}, false
+	}
+	graceUntil := endDate.Add(time.Duration(bch.GracePeriod))
+	return graceUntil, time.Now().Before(graceUntil)
+}
+
+// setGrace reports the end of the grace period in the X-Service-Grace
+// response header, as an RFC 3339 time.
+func (bch *BchAuth) setGrace(w http.ResponseWriter, graceUntil time.Time) {
+	w.Header().Set("X-Service-Grace", graceUntil.UTC().Format(time.RFC3339))
+	bch.setRemainingDays(w, 0)
+}
+
+// redisKey returns the Redis key of kind for id under cache_namespace.
+func (bch *BchAuth) redisKey(kind, id string) string {
+	return bch.CacheNamespace + ":" + kind + ":" + id
+}
+
+// capEndDate limits endDate to max_service_days from now.
+func (bch *BchAuth) capEndDate(endDate time.Time) time.Time {
+	if bch.MaxServiceDays <= 0 {
+		return endDate
 	}
+	if limit := time.Now().Add(time.Duration(bch.MaxServiceDays) * 24 * time.Hour); endDate.After(limit) {
+		return limit
+	}
+	return endDate
+}
+
+// setRemainingDays reports the remaining service days in the
+// X-Service-Days-Remaining response header when expose_remaining_days is
+// enabled. Whitelisted keys are reported as -1.
+func (bch *BchAuth) setRemainingDays(w http.ResponseWriter, days int) {
+	if bch.ExposeRemainingDays {
+		w.Header().Set("X-Service-Days-Remaining", strconv.Itoa(days))
+	}
+}
 
-	return totalServiceDays, nil
+// remainingDays returns the number of whole days left until endDate.
+func remainingDays(endDate time.Time) int {
+	return int(time.Until(endDate) / (24 * time.Hour))
 }
 
-// generateAddress derives the wallet address from the public key using Ed448.
+// generateAddress derives the wallet address from the public key using the
+// configured key scheme. Derived addresses are kept in an LRU cache of
+// address_cache_size entries.
 func (bch *BchAuth) generateAddress(pubKey string) (string, error) {
-	pubKeyBytes := common.FromHex(pubKey)
-	if len(pubKeyBytes) != 57 {
-		return "", errors.New("invalid public key length")
+	if bch.addrCache != nil {
+		if address, ok := bch.addrCache.Get(pubKey); ok {
+			return address, nil
+		}
+	}
+	raw, err := decodePublicKey(pubKey, bch.PubKeyEncoding)
+	if err != nil {
+		return "", fmt.Errorf("invalid public key encoding: %v", err)
+	}
+	scheme, err := bch.scheme()
+	if err != nil {
+		return "", err
+	}
+	address, err := scheme.Derive(raw)
+	if err != nil {
+		return "", err
+	}
+	if bch.addrCache != nil {
+		bch.addrCache.Add(pubKey, address)
+	}
+	return address, nil
+}
+
+// scheme returns the key scheme selected by key_type.
+func (bch *BchAuth) scheme() (keyScheme, error) {
+	if bch.keyScheme != nil {
+		return bch.keyScheme, nil
 	}
-	addr := crypto.SHA3(pubKeyBytes[:])[12:]
-	checksum := common.Hex2Bytes(common.CalculateChecksum(addr, bch.NetworkIDPrefix()))
-	return common.BytesToAddress(append(append(bch.NetworkIDPrefix(), checksum...), addr...)).Hex(), nil
+	prefix, err := bch.NetworkIDPrefix()
+	if err != nil {
+		return nil, err
+	}
+	return ed448Scheme{prefix: prefix}, nil
 }
 
 // UnmarshalCaddyfile sets up the module from Caddyfile.
@@ -188,9 +948,12 @@ func (bch *BchAuth) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 		for d.NextBlock(0) {
 			switch d.Val() {
 			case "dest_wallet":
-				if !d.Args(&bch.DestWallet) {
+				// Repeated dest_wallet lines add wallets
+				wallets := d.RemainingArgs()
+				if len(wallets) == 0 {
 					return d.Err("expected value for dest_wallet")
 				}
+				bch.DestWallets = append(bch.DestWallets, wallets...)
 			case "funds_ctn":
 				var fundsCTNStr string
 				if !d.Args(&fundsCTNStr) {
@@ -213,6 +976,20 @@ func (bch *BchAuth) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 				if !d.Args(&bch.RedisAddr) {
 					return d.Err("expected Redis address")
 				}
+			case "pg_schema":
+				if !d.Args(&bch.PGSchema) {
+					return d.Err("expected PostgreSQL schema name")
+				}
+				if strings.ContainsAny(bch.PGSchema, "; \t") {
+					return d.Err("pg_schema must not contain semicolons or spaces")
+				}
+			case "pg_table":
+				if !d.Args(&bch.PGTable) {
+					return d.Err("expected PostgreSQL table name")
+				}
+				if strings.ContainsAny(bch.PGTable, "; \t") {
+					return d.Err("pg_table must not contain semicolons or spaces")
+				}
 			case "network_id":
 				var networkIdStr string
 				if !d.Args(&networkIdStr) {
@@ -223,6 +1000,450 @@ func (bch *BchAuth) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 					return d.Err("invalid network ID format")
 				}
 				bch.NetworkId = networkId
+				if err := bch.ValidateNetworkId(); err != nil {
+					return d.Err(err.Error())
+				}
+			case "pg_max_open_conns":
+				var maxOpenStr string
+				if !d.Args(&maxOpenStr) {
+					return d.Err("expected value for pg_max_open_conns")
+				}
+				maxOpen, err := strconv.Atoi(maxOpenStr)
+				if err != nil || maxOpen < 0 {
+					return d.Err("pg_max_open_conns must be a non-negative integer")
+				}
+				bch.PGMaxOpenConns = maxOpen
+			case "pg_replica_conn_string":
+				if !d.Args(&bch.PGReplicaConnString) {
+					return d.Err("expected replica connection string")
+				}
+			case "pg_write_conn_string":
+				if !d.Args(&bch.PGWriteConnString) {
+					return d.Err("expected write connection string")
+				}
+			case "pg_replica_pool_size":
+				var poolStr string
+				if !d.Args(&poolStr) {
+					return d.Err("expected value for pg_replica_pool_size")
+				}
+				pool, err := strconv.Atoi(poolStr)
+				if err != nil || pool <= 0 {
+					return d.Err("pg_replica_pool_size must be a positive integer")
+				}
+				bch.PGReplicaPoolSize = pool
+			case "pg_max_idle_conns":
+				var maxIdleStr string
+				if !d.Args(&maxIdleStr) {
+					return d.Err("expected value for pg_max_idle_conns")
+				}
+				maxIdle, err := strconv.Atoi(maxIdleStr)
+				if err != nil || maxIdle < 0 {
+					return d.Err("pg_max_idle_conns must be a non-negative integer")
+				}
+				bch.PGMaxIdleConns = maxIdle
+			case "pg_conn_max_lifetime":
+				var lifetimeStr string
+				if !d.Args(&lifetimeStr) {
+					return d.Err("expected value for pg_conn_max_lifetime")
+				}
+				lifetime, err := caddy.ParseDuration(lifetimeStr)
+				if err != nil || lifetime < 0 {
+					return d.Err("pg_conn_max_lifetime must be a non-negative duration")
+				}
+				bch.PGConnMaxLifetime = caddy.Duration(lifetime)
+			case "redis_mode":
+				if !d.Args(&bch.RedisMode) {
+					return d.Err("expected Redis mode")
+				}
+				switch bch.RedisMode {
+				case redisModeSingle, redisModeSentinel, redisModeCluster:
+				default:
+					return d.Errf("unknown redis_mode %q", bch.RedisMode)
+				}
+			case "redis_sentinel_master":
+				if !d.Args(&bch.RedisSentinelMaster) {
+					return d.Err("expected Redis Sentinel master name")
+				}
+			case "optional_redis":
+				bch.OptionalRedis = true
+				if d.NextArg() {
+					optional, err := strconv.ParseBool(d.Val())
+					if err != nil {
+						return d.Err("invalid value for optional_redis")
+					}
+					bch.OptionalRedis = optional
+				}
+			case "expose_remaining_days":
+				bch.ExposeRemainingDays = true
+				if d.NextArg() {
+					expose, err := strconv.ParseBool(d.Val())
+					if err != nil {
+						return d.Err("invalid value for expose_remaining_days")
+					}
+					bch.ExposeRemainingDays = expose
+				}
+			case "tiers":
+				if err := bch.unmarshalTiers(d); err != nil {
+					return err
+				}
+			case "routes":
+				if err := bch.unmarshalRoutes(d); err != nil {
+					return err
+				}
+			case "require_signature":
+				bch.RequireSignature = true
+				if d.NextArg() {
+					require, err := strconv.ParseBool(d.Val())
+					if err != nil {
+						return d.Err("invalid value for require_signature")
+					}
+					bch.RequireSignature = require
+				}
+			case "signature_max_age":
+				var maxAgeStr string
+				if !d.Args(&maxAgeStr) {
+					return d.Err("expected value for signature_max_age")
+				}
+				maxAge, err := caddy.ParseDuration(maxAgeStr)
+				if err != nil || maxAge <= 0 {
+					return d.Err("signature_max_age must be a positive duration")
+				}
+				bch.SignatureMaxAge = caddy.Duration(maxAge)
+			case "negative_cache_ttl":
+				var ttlStr string
+				if !d.Args(&ttlStr) {
+					return d.Err("expected value for negative_cache_ttl")
+				}
+				ttl, err := caddy.ParseDuration(ttlStr)
+				if err != nil || ttl <= 0 {
+					return d.Err("negative_cache_ttl must be a positive duration")
+				}
+				bch.NegativeCacheTTL = caddy.Duration(ttl)
+			case "grace_period":
+				var graceStr string
+				if !d.Args(&graceStr) {
+					return d.Err("expected value for grace_period")
+				}
+				grace, err := caddy.ParseDuration(graceStr)
+				if err != nil || grace < 0 {
+					return d.Err("grace_period must be a non-negative duration")
+				}
+				bch.GracePeriod = caddy.Duration(grace)
+			case "metrics_enabled":
+				var enabledStr string
+				if !d.Args(&enabledStr) {
+					return d.Err("expected value for metrics_enabled")
+				}
+				enabled, err := strconv.ParseBool(enabledStr)
+				if err != nil {
+					return d.Err("invalid value for metrics_enabled")
+				}
+				bch.MetricsEnabled = &enabled
+			case "admin_path":
+				if !d.Args(&bch.AdminPath) {
+					return d.Err("expected admin path")
+				}
+				bch.AdminPath = strings.TrimSuffix(bch.AdminPath, "/")
+			case "admin_secret":
+				if !d.Args(&bch.AdminSecret) {
+					return d.Err("expected admin secret")
+				}
+			case "whitelist_entry":
+				args := d.RemainingArgs()
+				if len(args) < 1 || len(args) > 2 {
+					return d.Err("expected public key and optional RFC3339 expiry for whitelist_entry")
+				}
+				entry := WhitelistEntry{PubKey: args[0]}
+				if len(args) == 2 {
+					expires, err := time.Parse(time.RFC3339, args[1])
+					if err != nil {
+						return d.Err("invalid RFC3339 expiry for whitelist_entry")
+					}
+					entry.Expires = expires
+				}
+				bch.WhitelistEntries = append(bch.WhitelistEntries, entry)
+			case "whitelist_file":
+				if !d.Args(&bch.WhitelistFile) {
+					return d.Err("expected whitelist file path")
+				}
+			case "whitelist_reload_interval":
+				var intervalStr string
+				if !d.Args(&intervalStr) {
+					return d.Err("expected value for whitelist_reload_interval")
+				}
+				interval, err := caddy.ParseDuration(intervalStr)
+				if err != nil || interval <= 0 {
+					return d.Err("whitelist_reload_interval must be a positive duration")
+				}
+				bch.WhitelistReloadInterval = caddy.Duration(interval)
+			case "pubkey_header":
+				if !d.Args(&bch.PubKeyHeader) {
+					return d.Err("expected header name")
+				}
+			case "pubkey_cookie":
+				if !d.Args(&bch.PubKeyCookie) {
+					return d.Err("expected cookie name")
+				}
+			case "pubkey_query_param":
+				if !d.Args(&bch.PubKeyQueryParam) {
+					return d.Err("expected query parameter name")
+				}
+			case "pubkey_source":
+				bch.PubKeySource = d.RemainingArgs()
+				if len(bch.PubKeySource) == 0 {
+					return d.Err("expected at least one public key source")
+				}
+				if err := validatePubKeySource(bch.PubKeySource); err != nil {
+					return d.Err(err.Error())
+				}
+			case "webhook_url":
+				if !d.Args(&bch.WebhookURL) {
+					return d.Err("expected webhook URL")
+				}
+			case "webhook_notify_before":
+				var durationStr string
+				if !d.Args(&durationStr) {
+					return d.Err("expected value for webhook_notify_before")
+				}
+				dur, err := caddy.ParseDuration(durationStr)
+				if err != nil || dur <= 0 {
+					return d.Err("webhook_notify_before must be a positive duration")
+				}
+				bch.WebhookNotifyBefore = caddy.Duration(dur)
+			case "webhook_secret":
+				if !d.Args(&bch.WebhookSecret) {
+					return d.Err("expected webhook secret")
+				}
+			case "audit_log_table":
+				if !d.Args(&bch.AuditLogTable) {
+					return d.Err("expected audit log table name")
+				}
+			case "cache_warmup_interval", "cache_warmup_lookahead":
+				name := d.Val()
+				var durationStr string
+				if !d.Args(&durationStr) {
+					return d.Errf("expected value for %s", name)
+				}
+				dur, err := caddy.ParseDuration(durationStr)
+				if err != nil || dur <= 0 {
+					return d.Errf("%s must be a positive duration", name)
+				}
+				if name == "cache_warmup_interval" {
+					bch.CacheWarmupInterval = caddy.Duration(dur)
+				} else {
+					bch.CacheWarmupLookahead = caddy.Duration(dur)
+				}
+			case "cache_warmup_query_limit":
+				var limitStr string
+				if !d.Args(&limitStr) {
+					return d.Err("expected value for cache_warmup_query_limit")
+				}
+				limit, err := strconv.Atoi(limitStr)
+				if err != nil || limit <= 0 {
+					return d.Err("cache_warmup_query_limit must be a positive integer")
+				}
+				bch.CacheWarmupQueryLimit = limit
+			case "key_type":
+				if !d.Args(&bch.KeyType) {
+					return d.Err("expected key type")
+				}
+				if _, err := newKeyScheme(bch.KeyType, nil); err != nil {
+					return d.Err(err.Error())
+				}
+			case "billing_unit":
+				if !d.Args(&bch.BillingUnit) {
+					return d.Err("expected billing unit")
+				}
+				if err := validateBillingUnit(bch.BillingUnit); err != nil {
+					return d.Err(err.Error())
+				}
+			case "max_service_days":
+				var maxDaysStr string
+				if !d.Args(&maxDaysStr) {
+					return d.Err("expected value for max_service_days")
+				}
+				maxDays, err := strconv.Atoi(maxDaysStr)
+				if err != nil || maxDays <= 0 {
+					return d.Err("max_service_days must be a positive integer")
+				}
+				bch.MaxServiceDays = maxDays
+			case "enable_linked_addresses":
+				bch.EnableLinkedAddresses = true
+				if d.NextArg() {
+					enabled, err := strconv.ParseBool(d.Val())
+					if err != nil {
+						return d.Err("invalid value for enable_linked_addresses")
+					}
+					bch.EnableLinkedAddresses = enabled
+				}
+			case "match_sender":
+				bch.MatchSender = true
+				if d.NextArg() {
+					enabled, err := strconv.ParseBool(d.Val())
+					if err != nil {
+						return d.Err("invalid value for match_sender")
+					}
+					bch.MatchSender = enabled
+				}
+			case "accumulate_partial_payments":
+				bch.AccumulatePartialPayments = true
+				if d.NextArg() {
+					enabled, err := strconv.ParseBool(d.Val())
+					if err != nil {
+						return d.Err("invalid value for accumulate_partial_payments")
+					}
+					bch.AccumulatePartialPayments = enabled
+				}
+			case "max_tx_age":
+				var ageStr string
+				if !d.Args(&ageStr) {
+					return d.Err("expected value for max_tx_age")
+				}
+				age, err := caddy.ParseDuration(ageStr)
+				if err != nil || age < 0 {
+					return d.Errf("invalid max_tx_age %q", ageStr)
+				}
+				bch.MaxTxAge = caddy.Duration(age)
+			case "db_retry_attempts":
+				var attemptsStr string
+				if !d.Args(&attemptsStr) {
+					return d.Err("expected value for db_retry_attempts")
+				}
+				attempts, err := strconv.Atoi(attemptsStr)
+				if err != nil || attempts < 0 {
+					return d.Err("db_retry_attempts must be a non-negative integer")
+				}
+				bch.DBRetryAttempts = &attempts
+			case "db_retry_backoff":
+				var backoffStr string
+				if !d.Args(&backoffStr) {
+					return d.Err("expected value for db_retry_backoff")
+				}
+				backoff, err := caddy.ParseDuration(backoffStr)
+				if err != nil || backoff <= 0 {
+					return d.Errf("invalid db_retry_backoff %q", backoffStr)
+				}
+				bch.DBRetryBackoff = caddy.Duration(backoff)
+			case "cache_namespace":
+				if !d.Args(&bch.CacheNamespace) {
+					return d.Err("expected value for cache_namespace")
+				}
+			case "query_timeout":
+				var timeoutStr string
+				if !d.Args(&timeoutStr) {
+					return d.Err("expected value for query_timeout")
+				}
+				timeout, err := caddy.ParseDuration(timeoutStr)
+				if err != nil || timeout <= 0 {
+					return d.Err("query_timeout must be a positive duration")
+				}
+				bch.QueryTimeout = caddy.Duration(timeout)
+			case "provision_timeout":
+				var timeoutStr string
+				if !d.Args(&timeoutStr) {
+					return d.Err("expected value for provision_timeout")
+				}
+				timeout, err := caddy.ParseDuration(timeoutStr)
+				if err != nil || timeout <= 0 {
+					return d.Errf("invalid provision_timeout %q", timeoutStr)
+				}
+				bch.ProvisionTimeout = caddy.Duration(timeout)
+			case "db_driver":
+				if !d.Args(&bch.DBDriver) {
+					return d.Err("expected value for db_driver")
+				}
+				if _, err := sqlDriverName(bch.DBDriver); err != nil {
+					return d.Err(err.Error())
+				}
+			case "address_cache_size":
+				var sizeStr string
+				if !d.Args(&sizeStr) {
+					return d.Err("expected value for address_cache_size")
+				}
+				size, err := strconv.Atoi(sizeStr)
+				if err != nil || size <= 0 {
+					return d.Err("address_cache_size must be a positive integer")
+				}
+				bch.AddressCacheSize = size
+			case "pubkey_encoding":
+				if !d.Args(&bch.PubKeyEncoding) {
+					return d.Err("expected value for pubkey_encoding")
+				}
+				switch bch.PubKeyEncoding {
+				case pubKeyEncodingHex, pubKeyEncodingBase58, pubKeyEncodingBase64:
+				default:
+					return d.Errf("unknown pubkey_encoding %q: must be hex, base58 or base64", bch.PubKeyEncoding)
+				}
+			case "dry_run":
+				bch.DryRun = true
+				if d.NextArg() {
+					dryRun, err := strconv.ParseBool(d.Val())
+					if err != nil {
+						return d.Err("invalid value for dry_run")
+					}
+					bch.DryRun = dryRun
+				}
+			case "error_format":
+				if !d.Args(&bch.ErrorFormat) {
+					return d.Err("expected value for error_format")
+				}
+				if bch.ErrorFormat != errorFormatText && bch.ErrorFormat != errorFormatJSON {
+					return d.Errf("unknown error_format %q: must be text or json", bch.ErrorFormat)
+				}
+			case "redis_password":
+				if !d.Args(&bch.RedisPassword) {
+					return d.Err("expected value for redis_password")
+				}
+			case "redis_tls_cert":
+				if !d.Args(&bch.RedisTLSCert) {
+					return d.Err("expected value for redis_tls_cert")
+				}
+			case "redis_tls_key":
+				if !d.Args(&bch.RedisTLSKey) {
+					return d.Err("expected value for redis_tls_key")
+				}
+			case "redis_tls_ca":
+				if !d.Args(&bch.RedisTLSCA) {
+					return d.Err("expected value for redis_tls_ca")
+				}
+			case "rate_limit_rps":
+				var rpsStr string
+				if !d.Args(&rpsStr) {
+					return d.Err("expected value for rate_limit_rps")
+				}
+				rps, err := strconv.ParseFloat(rpsStr, 64)
+				if err != nil || rps < 0 {
+					return d.Err("rate_limit_rps must be a non-negative number")
+				}
+				bch.RateLimitRPS = rps
+			case "rate_limit_burst":
+				var burstStr string
+				if !d.Args(&burstStr) {
+					return d.Err("expected value for rate_limit_burst")
+				}
+				burst, err := strconv.Atoi(burstStr)
+				if err != nil || burst <= 0 {
+					return d.Err("rate_limit_burst must be a positive integer")
+				}
+				bch.RateLimitBurst = burst
+			case "rate_limit_ttl":
+				var ttlStr string
+				if !d.Args(&ttlStr) {
+					return d.Err("expected value for rate_limit_ttl")
+				}
+				ttl, err := caddy.ParseDuration(ttlStr)
+				if err != nil || ttl <= 0 {
+					return d.Errf("invalid rate_limit_ttl %q", ttlStr)
+				}
+				bch.RateLimitTTL = caddy.Duration(ttl)
+			case "trusted_proxies":
+				bch.TrustedProxies = append(bch.TrustedProxies, d.RemainingArgs()...)
+				if len(bch.TrustedProxies) == 0 {
+					return d.Err("expected at least one CIDR range")
+				}
+				if _, err := parseTrustedProxies(bch.TrustedProxies); err != nil {
+					return d.Err(err.Error())
+				}
 			case "whitelist":
 				args := d.RemainingArgs()
 				bch.Whitelist = args
@@ -232,26 +1453,95 @@ func (bch *BchAuth) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 	return nil
 }
 
-// Cleanup closes the PostgreSQL connection.
+// openWriteDB sets WriteDB for the tables bchauth writes itself. Without
+// pg_write_conn_string it shares DB, which must then accept those writes.
+func (bch *BchAuth) openWriteDB(ctx context.Context) error {
+	if bch.WriteDB != nil {
+		return nil
+	}
+	if bch.PGWriteConnString == "" {
+		bch.WriteDB = bch.DB
+		return nil
+	}
+	db, err := sql.Open(dbDriverPostgres, bch.PGWriteConnString)
+	if err != nil {
+		return fmt.Errorf("failed to connect to the write database: %v", err)
+	}
+	db.SetMaxOpenConns(bch.PGMaxOpenConns)
+	db.SetMaxIdleConns(bch.PGMaxIdleConns)
+	db.SetConnMaxLifetime(time.Duration(bch.PGConnMaxLifetime))
+	bch.WriteDB = db
+	pingCtx, cancel := context.WithTimeout(ctx, time.Duration(bch.ProvisionTimeout))
+	err = bch.WriteDB.PingContext(pingCtx)
+	cancel()
+	if err != nil {
+		return fmt.Errorf("failed to ping the write database: %v", err)
+	}
+	return nil
+}
+
+// goBackground runs fn in a goroutine that Cleanup waits for.
+func (bch *BchAuth) goBackground(fn func()) {
+	bch.background.Add(1)
+	go func() {
+		defer bch.background.Done()
+		fn()
+	}()
+}
+
+// Cleanup stops background tasks and closes the database and Redis
+// connections. It is safe to call more than once.
 func (bch *BchAuth) Cleanup() error {
+	unregisterInstance(bch)
+	if bch.cancel != nil {
+		bch.cancel()
+	}
+	// Background tasks use the clients, so they must exit first
+	if bch.background != nil {
+		bch.background.Wait()
+	}
+	var dbErr, replicaErr, writeErr, redisErr error
+	if bch.WriteDB != nil && bch.WriteDB != bch.DB {
+		writeErr = bch.WriteDB.Close()
+	}
+	bch.WriteDB = nil
 	if bch.DB != nil {
-		return bch.DB.Close()
+		dbErr = bch.DB.Close()
+		bch.DB = nil
 	}
-	return nil
+	if bch.ReplicaDB != nil {
+		replicaErr = bch.ReplicaDB.Close()
+		bch.ReplicaDB = nil
+	}
+	if bch.RedisClient != nil {
+		redisErr = bch.RedisClient.Close()
+		bch.RedisClient = nil
+	}
+	return errors.Join(dbErr, replicaErr, writeErr, redisErr)
 }
 
-func (bch *BchAuth) NetworkIDPrefix() []byte {
-	if bch.NetworkId == 1 {
-		return common.FromHex("cb")
-	} else if bch.NetworkId == 3 {
-		return common.FromHex("ab")
-	} else {
-		return common.FromHex("ce")
+// NetworkIDPrefix returns the address prefix of network_id: cb for
+// mainnet (1), ab for Devin (3) and ce for private networks (above 3). An
+// unset network_id (0) is a private network. Other IDs are rejected.
+func (bch *BchAuth) NetworkIDPrefix() ([]byte, error) {
+	switch {
+	case bch.NetworkId == 0:
+		return common.FromHex("ce"), nil
+	case bch.NetworkId < 0 || bch.NetworkId == 2:
+		return nil, fmt.Errorf("invalid network_id %d", bch.NetworkId)
 	}
+	return common.NetworkID(bch.NetworkId).Bytes(), nil
+}
+
+// ValidateNetworkId checks that network_id has an address prefix.
+func (bch *BchAuth) ValidateNetworkId() error {
+	_, err := bch.NetworkIDPrefix()
+	return err
 }
 
 // Interface guards
 var (
+	_ caddy.Validator             = (*BchAuth)(nil)
 	_ caddyhttp.MiddlewareHandler = (*BchAuth)(nil)
 	_ caddyfile.Unmarshaler       = (*BchAuth)(nil)
 )
@@ -0,0 +1,200 @@
+package bchauthtest
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/DataLayerHost/bchauth"
+	"github.com/go-redis/redis/v8"
+)
+
+// MemoryCache is an in-memory bchauth.CacheClient for use with
+// bchauth.NewBchAuthWithClients. Keys expire like in Redis. Err, when set,
+// is returned by every command instead, to exercise Redis failures.
+type MemoryCache struct {
+	Err error
+
+	mu     sync.Mutex
+	values map[string]cacheEntry
+	sorted map[string]map[string]float64
+}
+
+type cacheEntry struct {
+	value   string
+	expires time.Time // zero for no expiry
+}
+
+// lookup returns the live entry of key. The caller holds c.mu.
+func (c *MemoryCache) lookup(key string) (cacheEntry, bool) {
+	entry, ok := c.values[key]
+	if ok && !entry.expires.IsZero() && !time.Now().Before(entry.expires) {
+		delete(c.values, key)
+		return cacheEntry{}, false
+	}
+	return entry, ok
+}
+
+// Get returns the value of key, or redis.Nil if there is none.
+func (c *MemoryCache) Get(ctx context.Context, key string) *redis.StringCmd {
+	if c.Err != nil {
+		return redis.NewStringResult("", c.Err)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.lookup(key)
+	if !ok {
+		return redis.NewStringResult("", redis.Nil)
+	}
+	return redis.NewStringResult(entry.value, nil)
+}
+
+// Set stores value under key, formatted like go-redis does for strings and
+// numbers. A positive expiration makes the key expire.
+func (c *MemoryCache) Set(ctx context.Context, key string, value interface{}, expiration time.Duration) *redis.StatusCmd {
+	if c.Err != nil {
+		return redis.NewStatusResult("", c.Err)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.values == nil {
+		c.values = make(map[string]cacheEntry)
+	}
+	entry := cacheEntry{value: fmt.Sprint(value)}
+	if expiration > 0 {
+		entry.expires = time.Now().Add(expiration)
+	}
+	c.values[key] = entry
+	return redis.NewStatusResult("OK", nil)
+}
+
+// Exists counts how many of keys are set.
+func (c *MemoryCache) Exists(ctx context.Context, keys ...string) *redis.IntCmd {
+	if c.Err != nil {
+		return redis.NewIntResult(0, c.Err)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var n int64
+	for _, key := range keys {
+		if _, ok := c.lookup(key); ok {
+			n++
+		} else if _, ok := c.sorted[key]; ok {
+			n++
+		}
+	}
+	return redis.NewIntResult(n, nil)
+}
+
+// ZAdd adds or updates members of the sorted set key.
+func (c *MemoryCache) ZAdd(ctx context.Context, key string, members ...*redis.Z) *redis.IntCmd {
+	if c.Err != nil {
+		return redis.NewIntResult(0, c.Err)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.sorted == nil {
+		c.sorted = make(map[string]map[string]float64)
+	}
+	set := c.sorted[key]
+	if set == nil {
+		set = make(map[string]float64)
+		c.sorted[key] = set
+	}
+	var added int64
+	for _, m := range members {
+		member := fmt.Sprint(m.Member)
+		if _, ok := set[member]; !ok {
+			added++
+		}
+		set[member] = m.Score
+	}
+	return redis.NewIntResult(added, nil)
+}
+
+// ZRangeByScore returns the members of key scored between opt.Min and
+// opt.Max, inclusive, lowest first. Exclusive bounds are not supported.
+func (c *MemoryCache) ZRangeByScore(ctx context.Context, key string, opt *redis.ZRangeBy) *redis.StringSliceCmd {
+	if c.Err != nil {
+		return redis.NewStringSliceResult(nil, c.Err)
+	}
+	lo, err := parseScore(opt.Min)
+	if err != nil {
+		return redis.NewStringSliceResult(nil, err)
+	}
+	hi, err := parseScore(opt.Max)
+	if err != nil {
+		return redis.NewStringSliceResult(nil, err)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	set := c.sorted[key]
+	var members []string
+	for member, score := range set {
+		if score >= lo && score <= hi {
+			members = append(members, member)
+		}
+	}
+	sort.Slice(members, func(i, j int) bool {
+		if set[members[i]] != set[members[j]] {
+			return set[members[i]] < set[members[j]]
+		}
+		return members[i] < members[j]
+	})
+	if opt.Offset > 0 {
+		members = members[min(int(opt.Offset), len(members)):]
+	}
+	if opt.Count > 0 && int(opt.Count) < len(members) {
+		members = members[:opt.Count]
+	}
+	return redis.NewStringSliceResult(members, nil)
+}
+
+func parseScore(s string) (float64, error) {
+	switch s {
+	case "-inf":
+		return math.Inf(-1), nil
+	case "+inf", "inf":
+		return math.Inf(1), nil
+	}
+	return strconv.ParseFloat(s, 64)
+}
+
+// ZRem removes members from the sorted set key.
+func (c *MemoryCache) ZRem(ctx context.Context, key string, members ...interface{}) *redis.IntCmd {
+	if c.Err != nil {
+		return redis.NewIntResult(0, c.Err)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var removed int64
+	for _, m := range members {
+		member := fmt.Sprint(m)
+		if _, ok := c.sorted[key][member]; ok {
+			delete(c.sorted[key], member)
+			removed++
+		}
+	}
+	return redis.NewIntResult(removed, nil)
+}
+
+// Ping reports Err, or PONG.
+func (c *MemoryCache) Ping(ctx context.Context) *redis.StatusCmd {
+	if c.Err != nil {
+		return redis.NewStatusResult("", c.Err)
+	}
+	return redis.NewStatusResult("PONG", nil)
+}
+
+// Close does nothing.
+func (c *MemoryCache) Close() error {
+	return nil
+}
+
+// Interface guards
+var _ bchauth.CacheClient = (*MemoryCache)(nil)
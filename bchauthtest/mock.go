@@ -0,0 +1,89 @@
+// Package bchauthtest provides test doubles for code that depends on the
+// bchauth middleware.
+package bchauthtest
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/DataLayerHost/bchauth"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// MockBchAuth stands in for BchAuth without any database or cache. It
+// denies every key until configured with AllowAll or AllowKey.
+type MockBchAuth struct {
+	ActiveDays int // Days reported for allowed keys; 1 when zero
+
+	mu       sync.RWMutex
+	allowAll bool
+	allowed  map[string]bool
+}
+
+// AllowAll makes every key pass.
+func (m *MockBchAuth) AllowAll() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.allowAll = true
+}
+
+// DenyAll rejects every key, including keys added with AllowKey.
+func (m *MockBchAuth) DenyAll() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.allowAll = false
+	m.allowed = nil
+}
+
+// AllowKey lets key pass. The key is matched against the X-Pub-Key header
+// in ServeHTTP and against the address in CheckActiveService.
+func (m *MockBchAuth) AllowKey(key string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.allowed == nil {
+		m.allowed = make(map[string]bool)
+	}
+	m.allowed[strings.ToLower(key)] = true
+}
+
+func (m *MockBchAuth) isAllowed(key string) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.allowAll || m.allowed[strings.ToLower(key)]
+}
+
+// ServeHTTP mirrors the responses of BchAuth.ServeHTTP.
+func (m *MockBchAuth) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
+	pubKey := r.Header.Get("X-Pub-Key")
+	if pubKey == "" {
+		http.Error(w, "Missing X-Pub-Key", http.StatusForbidden)
+		return nil
+	}
+	if !m.isAllowed(pubKey) {
+		http.Error(w, "Service Expired", http.StatusForbidden)
+		return nil
+	}
+	return next.ServeHTTP(w, r)
+}
+
+// CheckActiveService reports service ending ActiveDays from now for allowed
+// addresses and a zero time otherwise.
+func (m *MockBchAuth) CheckActiveService(ctx context.Context, address string, destWallets []string, minFunds float64) (time.Time, error) {
+	if !m.isAllowed(address) {
+		return time.Time{}, nil
+	}
+	days := m.ActiveDays
+	if days == 0 {
+		days = 1
+	}
+	return time.Now().Add(time.Duration(days) * 24 * time.Hour), nil
+}
+
+// Interface guards
+var (
+	_ caddyhttp.MiddlewareHandler = (*MockBchAuth)(nil)
+	_ bchauth.AccessChecker       = (*MockBchAuth)(nil)
+)
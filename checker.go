@@ -0,0 +1,344 @@
+package bchauth
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/lib/pq"
+	"go.uber.org/zap"
+)
+
+func init() {
+	caddy.RegisterModule(PostgreSQLAccessChecker{})
+}
+
+// Default location of the transactions table. MySQL has no default schema,
+// so its table is left unqualified.
+const (
+	defaultPGSchema     = "public"
+	defaultSQLiteSchema = "main"
+	defaultPGTable      = "transactions"
+	defaultLinkedTable  = "bchauth_linked_addresses"
+)
+
+// AccessChecker reports until when an address has paid for service.
+// Implementations are registered as Caddy modules in the
+// http.handlers.bchauth.access_checkers namespace and selected with the
+// "driver" key of the access_checker config.
+type AccessChecker interface {
+	// CheckActiveService returns the time at which the paid service of
+	// address ends, counting payments to any of destWallets. A zero time
+	// means no payment was found.
+	CheckActiveService(ctx context.Context, address string, destWallets []string, minFunds float64) (time.Time, error)
+}
+
+// PostgreSQLAccessChecker calculates active service days from the
+// transactions stored in a PostgreSQL table. DBDriver selects MySQL or
+// SQLite instead.
+type PostgreSQLAccessChecker struct {
+	DB         DBClient `json:"-"`
+	ReplicaDB  DBClient `json:"-"`                     // Read replica tried before DB, if set
+	DBDriver   string   `json:"db_driver,omitempty"`   // Database driver: postgres (default), mysql or sqlite3
+	ConnString string   `json:"conn_string,omitempty"` // Database connection string
+	Schema     string   `json:"schema,omitempty"`      // Schema of the transactions table (default public)
+	Table      string   `json:"table,omitempty"`       // Table name for transactions (default transactions)
+
+	// ReplicaConnString opens ReplicaDB when it is not supplied.
+	ReplicaConnString string `json:"replica_conn_string,omitempty"`
+
+	// MaxServiceDays caps the returned end date at this many days from
+	// now. Zero means no cap.
+	MaxServiceDays int `json:"max_service_days,omitempty"`
+
+	// MaxTxAge ignores payments older than this. Zero counts every payment.
+	MaxTxAge caddy.Duration `json:"max_tx_age,omitempty"`
+
+	// LinkedAddresses also counts payments from the addresses linked to
+	// the queried address in LinkedTable (default bchauth_linked_addresses,
+	// in Schema). See migrations/001_linked_addresses.sql.
+	LinkedAddresses bool   `json:"linked_addresses,omitempty"`
+	LinkedTable     string `json:"linked_table,omitempty"`
+
+	// BillingUnit is the period one minFunds payment buys: day (default)
+	// or hour.
+	BillingUnit string `json:"billing_unit,omitempty"`
+
+	// AccumulatePartialPayments lets the value a payment has beyond whole
+	// periods count towards later ones, instead of being dropped.
+	AccumulatePartialPayments bool `json:"accumulate_partial_payments,omitempty"`
+
+	// MatchSender counts the rows sent from the queried address to one of
+	// destWallets, which needs the from_addr column of
+	// migrations/004_match_sender.sql. By default the rows whose to_addr is
+	// the queried address count, whatever destWallets holds.
+	MatchSender bool `json:"match_sender,omitempty"`
+
+	template string // access query with the table filled in
+	style    placeholderStyle
+	query    string // rendered template, PostgreSQL only
+	params   []string
+	ownsDB   bool
+	ownsRepl bool
+	logger   *zap.Logger
+}
+
+// CaddyModule returns the Caddy module information.
+func (PostgreSQLAccessChecker) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.handlers.bchauth.access_checkers.postgres",
+		New: func() caddy.Module { return new(PostgreSQLAccessChecker) },
+	}
+}
+
+// Provision builds the access-check query and opens the PostgreSQL
+// connection, and the replica connection if configured, unless they were
+// supplied.
+func (pg *PostgreSQLAccessChecker) Provision(ctx caddy.Context) error {
+	pg.logger = ctx.Logger(pg)
+	if err := pg.buildQuery(); err != nil {
+		return err
+	}
+	if pg.DB == nil {
+		db, err := pg.open(ctx, pg.ConnString)
+		if err != nil {
+			return err
+		}
+		pg.DB = db
+		pg.ownsDB = true
+	}
+	if pg.ReplicaDB == nil && pg.ReplicaConnString != "" {
+		db, err := pg.open(ctx, pg.ReplicaConnString)
+		if err != nil {
+			return fmt.Errorf("replica: %v", err)
+		}
+		pg.ReplicaDB = db
+		pg.ownsRepl = true
+	}
+	return nil
+}
+
+// open connects to connString and pings the database.
+func (pg *PostgreSQLAccessChecker) open(ctx context.Context, connString string) (*sql.DB, error) {
+	driverName, err := sqlDriverName(pg.DBDriver)
+	if err != nil {
+		return nil, err
+	}
+	db, err := sql.Open(driverName, connString)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s: %v", pg.DBDriver, err)
+	}
+	pingCtx, cancel := context.WithTimeout(ctx, defaultProvisionTimeout)
+	defer cancel()
+	if err := db.PingContext(pingCtx); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to ping %s: %v", pg.DBDriver, err)
+	}
+	return db, nil
+}
+
+// buildQuery renders the access-check query for the configured table. The
+// table name cannot be a bind parameter, so it is checked for characters
+// that would let the config inject SQL.
+func (pg *PostgreSQLAccessChecker) buildQuery() error {
+	if pg.DBDriver == "" {
+		pg.DBDriver = dbDriverPostgres
+	}
+	if _, err := sqlDriverName(pg.DBDriver); err != nil {
+		return err
+	}
+	if err := validateBillingUnit(pg.BillingUnit); err != nil {
+		return err
+	}
+	if pg.Schema == "" {
+		switch pg.DBDriver {
+		case dbDriverPostgres:
+			pg.Schema = defaultPGSchema
+		case dbDriverSQLite:
+			pg.Schema = defaultSQLiteSchema
+		}
+	}
+	if pg.Table == "" {
+		pg.Table = defaultPGTable
+	}
+	if pg.LinkedTable == "" {
+		pg.LinkedTable = defaultLinkedTable
+	}
+	for _, name := range []string{pg.Schema, pg.Table, pg.LinkedTable} {
+		if strings.ContainsAny(name, "; \t\r\n") {
+			return fmt.Errorf("invalid PostgreSQL identifier %q", name)
+		}
+	}
+	table, linkedTable := pg.Table, pg.LinkedTable
+	if pg.Schema != "" {
+		table = fmt.Sprintf("%s.%s", pg.Schema, pg.Table)
+		linkedTable = fmt.Sprintf("%s.%s", pg.Schema, pg.LinkedTable)
+	}
+	pg.template = fmt.Sprintf(queryFor(pg.DBDriver, pg.AccumulatePartialPayments), table, txAgeFilter(pg.DBDriver, time.Duration(pg.MaxTxAge)), table)
+	pg.template = strings.ReplaceAll(pg.template, "{unit}", billingUnitSQL(pg.DBDriver, pg.BillingUnit))
+	pg.template = strings.ReplaceAll(pg.template, "{match}", paymentMatch(pg.DBDriver, pg.MatchSender, pg.LinkedAddresses, linkedTable))
+	pg.style = placeholderStyleFor(pg.DBDriver)
+	if pg.style == placeholderDollar {
+		pg.query, pg.params = pg.style.render(pg.template, 0)
+	}
+	return nil
+}
+
+// Cleanup closes the database connections opened by Provision.
+func (pg *PostgreSQLAccessChecker) Cleanup() error {
+	var dbErr, replicaErr error
+	if pg.ownsDB && pg.DB != nil {
+		dbErr = pg.DB.Close()
+	}
+	if pg.ownsRepl && pg.ReplicaDB != nil {
+		replicaErr = pg.ReplicaDB.Close()
+	}
+	return errors.Join(dbErr, replicaErr)
+}
+
+// CheckActiveService queries the database for the end of the latest service
+// period that has started, based on the transactions to address or, with
+// MatchSender, those sent from address to any of destWallets. The query
+// runs on ReplicaDB when there is one, and again on DB if the replica
+// fails.
+func (pg *PostgreSQLAccessChecker) CheckActiveService(ctx context.Context, address string, destWallets []string, minFunds float64) (time.Time, error) {
+	if pg.MatchSender && len(destWallets) == 0 {
+		return time.Time{}, nil
+	}
+
+	// A NULL cap leaves LEAST with the uncapped end date
+	maxDays := sql.NullInt64{Int64: int64(pg.MaxServiceDays), Valid: pg.MaxServiceDays > 0}
+
+	query, params := pg.query, pg.params
+	if pg.style != placeholderDollar {
+		query, params = pg.style.render(pg.template, len(destWallets))
+	}
+
+	values := map[string]interface{}{
+		"address":      address,
+		"dest_wallets": pq.Array(destWallets),
+		"min_funds":    minFunds,
+		"max_days":     maxDays,
+	}
+	args := make([]interface{}, len(params))
+	wallet := 0
+	for i, name := range params {
+		if name == "dest_wallets" && pg.style != placeholderDollar {
+			// Every expanded list binds the wallets in order
+			args[i] = destWallets[wallet%len(destWallets)]
+			wallet++
+			continue
+		}
+		args[i] = values[name]
+	}
+
+	var endDate interface{}
+	if pg.ReplicaDB != nil {
+		err := pg.ReplicaDB.QueryRowContext(ctx, query, args...).Scan(&endDate)
+		if err == nil {
+			return scanEndDate(endDate)
+		}
+		if ctx.Err() != nil {
+			return time.Time{}, err
+		}
+		if pg.logger != nil {
+			pg.logger.Warn("replica query failed, using the primary database", zap.Error(err))
+		}
+	}
+	if err := pg.DB.QueryRowContext(ctx, query, args...).Scan(&endDate); err != nil {
+		return time.Time{}, err
+	}
+
+	return scanEndDate(endDate)
+}
+
+// accessQuery finds the end of the latest service period that has started,
+// capped at {max_days} days from now. Each payment buys
+// FLOOR(value / {min_funds}) periods of one {unit}. It is formatted with the qualified
+// transactions table, the txAgeFilter and the table again.
+const accessQuery = `
+	WITH RECURSIVE service_periods AS (
+		SELECT
+			t.created_at AS start_date,
+			t.created_at + INTERVAL '1 {unit}' * FLOOR(t.value::NUMERIC / {min_funds}) AS end_date,
+			FLOOR(t.value::NUMERIC / {min_funds}) AS service_days
+		FROM %s t
+		WHERE {match}
+		  %s
+
+		UNION ALL
+
+		SELECT
+			CASE
+				WHEN t.created_at > sp.end_date THEN t.created_at
+				ELSE sp.start_date
+			END AS start_date,
+			t.created_at + INTERVAL '1 {unit}' * FLOOR(t.value::NUMERIC / {min_funds}) AS end_date,
+			sp.service_days + FLOOR(t.value::NUMERIC / {min_funds}) AS service_days
+		FROM %s t
+		JOIN service_periods sp
+			ON {match}
+		   AND t.created_at > sp.end_date
+	)
+	SELECT LEAST(MAX(end_date), NOW() + INTERVAL '1 day' * {max_days}::INTEGER)::TIMESTAMPTZ AS end_date
+	FROM service_periods
+	WHERE start_date <= NOW();
+`
+
+// accumulatingAccessQuery is accessQuery for accumulate_partial_payments.
+// Payments are taken in order, and each one adds its value to the credit
+// of the current service period, which lasts FLOOR(credit / {min_funds})
+// units from its start. A payment after the period has ended starts a new
+// one, carrying over the remainder that did not buy a whole unit. Unlike
+// the other templates, it uses the table and the txAgeFilter once, so the
+// arguments are referenced by index.
+const accumulatingAccessQuery = `
+	WITH RECURSIVE payments AS (
+		SELECT
+			t.created_at,
+			t.value::NUMERIC AS value,
+			ROW_NUMBER() OVER (ORDER BY t.created_at) AS rn
+		FROM %[1]s t
+		WHERE {match}
+		  %[2]s
+	),
+	service_periods AS (
+		SELECT
+			p.rn,
+			p.created_at AS start_date,
+			p.value AS credit,
+			p.created_at + INTERVAL '1 {unit}' * FLOOR(p.value / {min_funds}) AS end_date
+		FROM payments p
+		WHERE p.rn = 1
+
+		UNION ALL
+
+		SELECT
+			p.rn,
+			CASE WHEN p.created_at > sp.end_date THEN p.created_at ELSE sp.start_date END AS start_date,
+			CASE
+				WHEN p.created_at > sp.end_date THEN sp.credit - FLOOR(sp.credit / {min_funds}) * {min_funds} + p.value
+				ELSE sp.credit + p.value
+			END AS credit,
+			CASE
+				WHEN p.created_at > sp.end_date THEN p.created_at + INTERVAL '1 {unit}' * FLOOR((sp.credit - FLOOR(sp.credit / {min_funds}) * {min_funds} + p.value) / {min_funds})
+				ELSE sp.start_date + INTERVAL '1 {unit}' * FLOOR((sp.credit + p.value) / {min_funds})
+			END AS end_date
+		FROM service_periods sp
+		JOIN payments p ON p.rn = sp.rn + 1
+	)
+	SELECT LEAST(MAX(end_date), NOW() + INTERVAL '1 day' * {max_days}::INTEGER)::TIMESTAMPTZ AS end_date
+	FROM service_periods
+	WHERE start_date <= NOW();
+`
+
+// Interface guards
+var (
+	_ AccessChecker      = (*PostgreSQLAccessChecker)(nil)
+	_ caddy.Provisioner  = (*PostgreSQLAccessChecker)(nil)
+	_ caddy.CleanerUpper = (*PostgreSQLAccessChecker)(nil)
+)
@@ -0,0 +1,61 @@
+package bchauth
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// parseTrustedProxies parses trusted_proxies entries, each a CIDR range or
+// a single IP address.
+func parseTrustedProxies(entries []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(entries))
+	for _, entry := range entries {
+		if !strings.Contains(entry, "/") {
+			addr, err := netip.ParseAddr(entry)
+			if err != nil {
+				return nil, fmt.Errorf("invalid trusted_proxies entry %q: %v", entry, err)
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted_proxies entry %q: %v", entry, err)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+// clientIP returns the IP address of the client that sent r. When the
+// connection comes from one of trusted_proxies, it is the leftmost address
+// in X-Forwarded-For. Otherwise the header could be set by anyone and is
+// ignored.
+func (bch *BchAuth) clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	remote, err := netip.ParseAddr(host)
+	if err != nil || !bch.trustedProxy(remote.Unmap()) {
+		return host
+	}
+	first, _, _ := strings.Cut(r.Header.Get("X-Forwarded-For"), ",")
+	if forwarded, err := netip.ParseAddr(strings.TrimSpace(first)); err == nil {
+		return forwarded.Unmap().String()
+	}
+	return host
+}
+
+// trustedProxy reports whether addr is in one of trusted_proxies.
+func (bch *BchAuth) trustedProxy(addr netip.Addr) bool {
+	for _, prefix := range bch.trustedProxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,75 @@
+package bchauth
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/go-redis/redis/v8"
+	"go.uber.org/zap"
+	"golang.org/x/sync/singleflight"
+)
+
+// DBClient is the part of *sql.DB that the handler and the built-in access
+// checker use.
+type DBClient interface {
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	PingContext(ctx context.Context) error
+	Close() error
+}
+
+// CacheClient is the part of redis.UniversalClient that the handler uses.
+// Replies can be faked with redis.NewStringResult and friends.
+type CacheClient interface {
+	Get(ctx context.Context, key string) *redis.StringCmd
+	Set(ctx context.Context, key string, value interface{}, expiration time.Duration) *redis.StatusCmd
+	Exists(ctx context.Context, keys ...string) *redis.IntCmd
+	ZAdd(ctx context.Context, key string, members ...*redis.Z) *redis.IntCmd
+	ZRangeByScore(ctx context.Context, key string, opt *redis.ZRangeBy) *redis.StringSliceCmd
+	ZRem(ctx context.Context, key string, members ...interface{}) *redis.IntCmd
+	Ping(ctx context.Context) *redis.StatusCmd
+	Close() error
+}
+
+// NewBchAuthWithClients returns a handler that serves requests with the
+// given clients, without Provision, so it can run against test doubles.
+// A nil cache runs the handler without Redis, like optional_redis without
+// redis_addr.
+// Unless db is nil, access is checked with the default PostgreSQL query on
+// db; assign AccessChecker to use another checker. Configuration fields
+// are read at request time, including rate limits, whose idle limiters are
+// not purged. Options that Provision turns into state or background tasks,
+// such as whitelist_file, cache warm-up or webhooks, have no effect.
+func NewBchAuthWithClients(db DBClient, cache CacheClient) *BchAuth {
+	bch := &BchAuth{
+		DB:               db,
+		WriteDB:          db,
+		RedisClient:      cache,
+		CacheNamespace:   defaultCacheNamespace,
+		MaxServiceDays:   defaultMaxServiceDays,
+		NegativeCacheTTL: caddy.Duration(defaultNegativeCacheTTL),
+		DBRetryBackoff:   caddy.Duration(defaultDBRetryBackoff),
+		QueryTimeout:     caddy.Duration(defaultQueryTimeout),
+		inflight:         new(singleflight.Group),
+		limiters:         new(sync.Map),
+		background:       new(sync.WaitGroup),
+		logger:           zap.NewNop(),
+	}
+	if db != nil {
+		checker := &PostgreSQLAccessChecker{DB: db, MaxServiceDays: bch.MaxServiceDays}
+		// The default table and schema are always valid
+		_ = checker.buildQuery()
+		bch.AccessChecker = checker
+	}
+	return bch
+}
+
+// Interface guards
+var (
+	_ DBClient    = (*sql.DB)(nil)
+	_ CacheClient = (redis.UniversalClient)(nil)
+)
@@ -0,0 +1,360 @@
+package bchauth
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	_ "github.com/go-sql-driver/mysql" // MySQL driver
+	_ "modernc.org/sqlite"             // SQLite driver
+)
+
+// Supported values of db_driver.
+const (
+	dbDriverPostgres = "postgres"
+	dbDriverMySQL    = "mysql"
+	dbDriverSQLite   = "sqlite3"
+)
+
+// sqlDriverNames maps a db_driver value to the name its database/sql driver
+// registers. The pure Go SQLite driver registers itself as "sqlite".
+var sqlDriverNames = map[string]string{
+	dbDriverPostgres: "postgres",
+	dbDriverMySQL:    "mysql",
+	dbDriverSQLite:   "sqlite",
+}
+
+// sqlDriverName returns the database/sql driver name for a db_driver value.
+// An empty value selects PostgreSQL.
+func sqlDriverName(driver string) (string, error) {
+	if driver == "" {
+		driver = dbDriverPostgres
+	}
+	name, ok := sqlDriverNames[driver]
+	if !ok {
+		return "", fmt.Errorf("unsupported db_driver %q: must be postgres, mysql or sqlite3", driver)
+	}
+	return name, nil
+}
+
+// placeholderStyle is the bind parameter syntax of a database driver.
+type placeholderStyle int
+
+const (
+	// placeholderDollar numbers parameters as $1, $2, ... (PostgreSQL).
+	placeholderDollar placeholderStyle = iota
+	// placeholderQuestion binds one ? per occurrence (MySQL, SQLite).
+	placeholderQuestion
+)
+
+var queryParamPattern = regexp.MustCompile(`\{(address|dest_wallets|min_funds|max_days)\}`)
+
+// placeholderStyleFor returns the bind parameter syntax of driver.
+func placeholderStyleFor(driver string) placeholderStyle {
+	if driver == "" || driver == dbDriverPostgres {
+		return placeholderDollar
+	}
+	return placeholderQuestion
+}
+
+// render replaces the {name} markers of a query template with bind
+// parameters and returns the names of the arguments in bind order.
+// PostgreSQL numbers each name once, in order of appearance, and binds
+// dest_wallets as a single array; names the template does not use are not
+// bound. With ? placeholders, each occurrence of dest_wallets expands to
+// walletCount parameters instead.
+func (ps placeholderStyle) render(tmpl string, walletCount int) (string, []string) {
+	if ps == placeholderDollar {
+		var params []string
+		query := queryParamPattern.ReplaceAllStringFunc(tmpl, func(m string) string {
+			name := m[1 : len(m)-1]
+			i := slices.Index(params, name)
+			if i < 0 {
+				params = append(params, name)
+				i = len(params) - 1
+			}
+			return "$" + strconv.Itoa(i+1)
+		})
+		return query, params
+	}
+
+	var params []string
+	query := queryParamPattern.ReplaceAllStringFunc(tmpl, func(m string) string {
+		name := m[1 : len(m)-1]
+		if name != "dest_wallets" {
+			params = append(params, name)
+			return "?"
+		}
+		for i := 0; i < walletCount; i++ {
+			params = append(params, name)
+		}
+		return strings.TrimSuffix(strings.Repeat("?, ", walletCount), ", ")
+	})
+	return query, params
+}
+
+// paymentMatch returns the condition that selects the payments of
+// {address}, the {match} marker of the query templates. Rows whose to_addr
+// is the address count, or with matchSender those sent from it to one of
+// {dest_wallets}. With linked, the addresses linked to it in linkedTable
+// count as well.
+func paymentMatch(driver string, matchSender, linked bool, linkedTable string) string {
+	column := "t.to_addr"
+	if matchSender {
+		column = "t.from_addr"
+	}
+	match := column + " = {address}"
+	if linked {
+		// The subquery is portable across the supported dialects
+		match = fmt.Sprintf("%s IN (SELECT {address} UNION SELECT linked_address FROM %s WHERE canonical_address = {address})",
+			column, linkedTable)
+	}
+	if !matchSender {
+		return match
+	}
+	if driver == "" || driver == dbDriverPostgres {
+		return match + " AND t.to_addr = ANY({dest_wallets})"
+	}
+	return match + " AND t.to_addr IN ({dest_wallets})"
+}
+
+// queryFor returns the access query template for driver, accumulating
+// partial payments if accumulate is set. Templates are formatted with the
+// qualified transactions table, the txAgeFilter and the table again, and
+// use {name} markers for bind parameters. {unit} stands for the billing
+// unit, see billingUnitSQL, and {match} for the payments that count, see
+// paymentMatch.
+func queryFor(driver string, accumulate bool) string {
+	switch {
+	case driver == dbDriverMySQL && accumulate:
+		return mysqlAccumulatingAccessQuery
+	case driver == dbDriverMySQL:
+		return mysqlAccessQuery
+	case driver == dbDriverSQLite && accumulate:
+		return sqliteAccumulatingAccessQuery
+	case driver == dbDriverSQLite:
+		return sqliteAccessQuery
+	case accumulate:
+		return accumulatingAccessQuery
+	}
+	return accessQuery
+}
+
+// Supported values of billing_unit.
+const (
+	billingUnitDay  = "day"
+	billingUnitHour = "hour"
+)
+
+// validateBillingUnit checks that unit is a known billing_unit. An empty
+// unit is day.
+func validateBillingUnit(unit string) error {
+	switch unit {
+	case "", billingUnitDay, billingUnitHour:
+		return nil
+	}
+	return fmt.Errorf("unknown billing_unit %q: must be day or hour", unit)
+}
+
+// billingUnitSQL returns the text that replaces {unit} in the query
+// template of driver: the interval unit that one min_funds payment buys.
+func billingUnitSQL(driver, unit string) string {
+	if unit == "" {
+		unit = billingUnitDay
+	}
+	switch driver {
+	case dbDriverMySQL:
+		return strings.ToUpper(unit)
+	case dbDriverSQLite:
+		return unit + "s"
+	}
+	return unit
+}
+
+// txAgeFilter returns the condition that limits the base case of the access
+// query to payments made within maxAge, or "" when maxAge is zero.
+func txAgeFilter(driver string, maxAge time.Duration) string {
+	secs := int64(maxAge / time.Second)
+	if secs <= 0 {
+		return ""
+	}
+	switch driver {
+	case dbDriverMySQL:
+		return fmt.Sprintf("AND t.created_at >= NOW() - INTERVAL %d SECOND", secs)
+	case dbDriverSQLite:
+		return fmt.Sprintf("AND t.created_at >= datetime('now', '-%d seconds')", secs)
+	}
+	return fmt.Sprintf("AND t.created_at >= NOW() - INTERVAL '%d seconds'", secs)
+}
+
+// scanEndDate converts the end date selected by an access query into a
+// time. PostgreSQL returns a timestamp, MySQL and SQLite return Unix seconds.
+func scanEndDate(v interface{}) (time.Time, error) {
+	switch v := v.(type) {
+	case nil:
+		return time.Time{}, nil
+	case time.Time:
+		return v, nil
+	case int64:
+		return time.Unix(v, 0), nil
+	case float64:
+		return time.Unix(int64(v), 0), nil
+	case []byte:
+		return scanEndDate(string(v))
+	case string:
+		secs, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid end date %q: %v", v, err)
+		}
+		return time.Unix(int64(secs), 0), nil
+	}
+	return time.Time{}, fmt.Errorf("unexpected end date type %T", v)
+}
+
+// mysqlAccessQuery is accessQuery for MySQL 8 and later.
+const mysqlAccessQuery = `
+	WITH RECURSIVE service_periods AS (
+		SELECT
+			t.created_at AS start_date,
+			DATE_ADD(t.created_at, INTERVAL FLOOR(t.value / {min_funds}) {unit}) AS end_date,
+			FLOOR(t.value / {min_funds}) AS service_days
+		FROM %s t
+		WHERE {match}
+		  %s
+
+		UNION ALL
+
+		SELECT
+			CASE
+				WHEN t.created_at > sp.end_date THEN t.created_at
+				ELSE sp.start_date
+			END AS start_date,
+			DATE_ADD(t.created_at, INTERVAL FLOOR(t.value / {min_funds}) {unit}) AS end_date,
+			sp.service_days + FLOOR(t.value / {min_funds}) AS service_days
+		FROM %s t
+		JOIN service_periods sp
+			ON {match}
+		   AND t.created_at > sp.end_date
+	)
+	SELECT UNIX_TIMESTAMP(LEAST(MAX(end_date), COALESCE(NOW() + INTERVAL {max_days} DAY, MAX(end_date)))) AS end_date
+	FROM service_periods
+	WHERE start_date <= NOW();
+`
+
+// sqliteAccessQuery is accessQuery for SQLite. created_at must be stored as
+// UTC text in the "YYYY-MM-DD HH:MM:SS" format produced by datetime().
+const sqliteAccessQuery = `
+	WITH RECURSIVE service_periods AS (
+		SELECT
+			t.created_at AS start_date,
+			datetime(t.created_at, '+' || CAST(t.value / {min_funds} AS INTEGER) || ' {unit}') AS end_date,
+			CAST(t.value / {min_funds} AS INTEGER) AS service_days
+		FROM %s t
+		WHERE {match}
+		  %s
+
+		UNION ALL
+
+		SELECT
+			CASE
+				WHEN t.created_at > sp.end_date THEN t.created_at
+				ELSE sp.start_date
+			END AS start_date,
+			datetime(t.created_at, '+' || CAST(t.value / {min_funds} AS INTEGER) || ' {unit}') AS end_date,
+			sp.service_days + CAST(t.value / {min_funds} AS INTEGER) AS service_days
+		FROM %s t
+		JOIN service_periods sp
+			ON {match}
+		   AND t.created_at > sp.end_date
+	)
+	SELECT CAST(strftime('%%s', MIN(MAX(end_date), COALESCE(datetime('now', '+' || {max_days} || ' days'), MAX(end_date)))) AS INTEGER) AS end_date
+	FROM service_periods
+	WHERE start_date <= datetime('now');
+`
+
+// mysqlAccumulatingAccessQuery is accumulatingAccessQuery for MySQL 8 and
+// later. The credit is widened so that the recursive sums are not
+// truncated to the type of the first payment.
+const mysqlAccumulatingAccessQuery = `
+	WITH RECURSIVE payments AS (
+		SELECT
+			t.created_at,
+			t.value,
+			ROW_NUMBER() OVER (ORDER BY t.created_at) AS rn
+		FROM %[1]s t
+		WHERE {match}
+		  %[2]s
+	),
+	service_periods AS (
+		SELECT
+			p.rn,
+			p.created_at AS start_date,
+			CAST(p.value AS DECIMAL(65, 18)) AS credit,
+			DATE_ADD(p.created_at, INTERVAL FLOOR(p.value / {min_funds}) {unit}) AS end_date
+		FROM payments p
+		WHERE p.rn = 1
+
+		UNION ALL
+
+		SELECT
+			p.rn,
+			CASE WHEN p.created_at > sp.end_date THEN p.created_at ELSE sp.start_date END AS start_date,
+			CASE
+				WHEN p.created_at > sp.end_date THEN sp.credit - FLOOR(sp.credit / {min_funds}) * {min_funds} + p.value
+				ELSE sp.credit + p.value
+			END AS credit,
+			CASE
+				WHEN p.created_at > sp.end_date THEN DATE_ADD(p.created_at, INTERVAL FLOOR((sp.credit - FLOOR(sp.credit / {min_funds}) * {min_funds} + p.value) / {min_funds}) {unit})
+				ELSE DATE_ADD(sp.start_date, INTERVAL FLOOR((sp.credit + p.value) / {min_funds}) {unit})
+			END AS end_date
+		FROM service_periods sp
+		JOIN payments p ON p.rn = sp.rn + 1
+	)
+	SELECT UNIX_TIMESTAMP(LEAST(MAX(end_date), COALESCE(NOW() + INTERVAL {max_days} DAY, MAX(end_date)))) AS end_date
+	FROM service_periods
+	WHERE start_date <= NOW();
+`
+
+// sqliteAccumulatingAccessQuery is accumulatingAccessQuery for SQLite.
+const sqliteAccumulatingAccessQuery = `
+	WITH RECURSIVE payments AS (
+		SELECT
+			t.created_at,
+			t.value,
+			ROW_NUMBER() OVER (ORDER BY t.created_at) AS rn
+		FROM %[1]s t
+		WHERE {match}
+		  %[2]s
+	),
+	service_periods AS (
+		SELECT
+			p.rn,
+			p.created_at AS start_date,
+			p.value AS credit,
+			datetime(p.created_at, '+' || CAST(p.value / {min_funds} AS INTEGER) || ' {unit}') AS end_date
+		FROM payments p
+		WHERE p.rn = 1
+
+		UNION ALL
+
+		SELECT
+			p.rn,
+			CASE WHEN p.created_at > sp.end_date THEN p.created_at ELSE sp.start_date END AS start_date,
+			CASE
+				WHEN p.created_at > sp.end_date THEN sp.credit - CAST(sp.credit / {min_funds} AS INTEGER) * {min_funds} + p.value
+				ELSE sp.credit + p.value
+			END AS credit,
+			CASE
+				WHEN p.created_at > sp.end_date THEN datetime(p.created_at, '+' || CAST((sp.credit - CAST(sp.credit / {min_funds} AS INTEGER) * {min_funds} + p.value) / {min_funds} AS INTEGER) || ' {unit}')
+				ELSE datetime(sp.start_date, '+' || CAST((sp.credit + p.value) / {min_funds} AS INTEGER) || ' {unit}')
+			END AS end_date
+		FROM service_periods sp
+		JOIN payments p ON p.rn = sp.rn + 1
+	)
+	SELECT CAST(strftime('%%s', MIN(MAX(end_date), COALESCE(datetime('now', '+' || {max_days} || ' days'), MAX(end_date)))) AS INTEGER) AS end_date
+	FROM service_periods
+	WHERE start_date <= datetime('now');
+`
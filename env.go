@@ -0,0 +1,49 @@
+package bchauth
+
+import (
+	"os"
+	"reflect"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// newEnvReplacer returns a replacer that only knows {env.*} placeholders
+// of variables that are set.
+func newEnvReplacer() *caddy.Replacer {
+	repl := caddy.NewEmptyReplacer()
+	repl.Map(func(key string) (interface{}, bool) {
+		if name, ok := strings.CutPrefix(key, "env."); ok {
+			return os.LookupEnv(name)
+		}
+		return nil, false
+	})
+	return repl
+}
+
+// expandEnv replaces {env.VAR} placeholders in the exported string and
+// string slice fields of bch. Placeholders of unset variables are left in
+// place so that Validate reports them.
+func (bch *BchAuth) expandEnv() {
+	repl := newEnvReplacer()
+	v := reflect.ValueOf(bch).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Field(i)
+		if !v.Type().Field(i).IsExported() {
+			continue
+		}
+		switch {
+		case field.Kind() == reflect.String:
+			field.SetString(repl.ReplaceKnown(field.String(), ""))
+		case field.Kind() == reflect.Slice && field.Type().Elem().Kind() == reflect.String:
+			for j := 0; j < field.Len(); j++ {
+				field.Index(j).SetString(repl.ReplaceKnown(field.Index(j).String(), ""))
+			}
+		}
+	}
+}
+
+// unexpandedEnv reports whether s still holds an {env.*} placeholder.
+func unexpandedEnv(s string) bool {
+	return strings.Contains(s, "{env.")
+}
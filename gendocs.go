@@ -0,0 +1,177 @@
+//go:build ignore
+
+// gendocs renders the Caddyfile syntax reference in generated_docs.go from
+// the JSON tags and field comments of the BchAuth struct. Run it with
+// `go generate` after changing the configuration fields.
+//
+// A field's Caddyfile name defaults to its JSON tag. It can be overridden
+// with a `caddyfile:"name"` tag, or with a full usage line such as
+// `caddyfile:"name <arg> [<optional>]"`. `caddyfile:"-"` hides a JSON-only
+// field from the reference.
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"text/tabwriter"
+	"unicode"
+)
+
+const typeName = "BchAuth"
+
+func main() {
+	st, err := findStruct(".")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var syntax bytes.Buffer
+	syntax.WriteString("bchauth {\n")
+	tw := tabwriter.NewWriter(&syntax, 0, 4, 1, ' ', 0)
+	for _, field := range st.Fields.List {
+		name := directiveName(field)
+		if name == "" {
+			continue
+		}
+		line := "    " + name
+		if !strings.Contains(name, " ") {
+			line += " " + placeholder(field.Type)
+		}
+		if comment := fieldComment(field); comment != "" {
+			line += "\t# " + comment
+		}
+		fmt.Fprintln(tw, line)
+	}
+	if err := tw.Flush(); err != nil {
+		log.Fatal(err)
+	}
+	syntax.WriteString("}\n")
+
+	var src bytes.Buffer
+	src.WriteString("// Code generated by gendocs.go; DO NOT EDIT.\n\n")
+	src.WriteString("package bchauth\n\n")
+	src.WriteString("// CaddyfileSyntax is the Caddyfile syntax reference for the bchauth directive.\n")
+	fmt.Fprintf(&src, "const CaddyfileSyntax = `%s`\n", syntax.String())
+
+	out, err := format.Source(src.Bytes())
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := os.WriteFile("generated_docs.go", out, 0o644); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// findStruct locates the BchAuth struct declaration in the package sources.
+func findStruct(dir string) (*ast.StructType, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.go"))
+	if err != nil {
+		return nil, err
+	}
+	fset := token.NewFileSet()
+	for _, name := range files {
+		if strings.HasSuffix(name, "_test.go") {
+			continue
+		}
+		f, err := parser.ParseFile(fset, name, nil, parser.ParseComments)
+		if err != nil {
+			return nil, err
+		}
+		for _, decl := range f.Decls {
+			gen, ok := decl.(*ast.GenDecl)
+			if !ok || gen.Tok != token.TYPE {
+				continue
+			}
+			for _, spec := range gen.Specs {
+				ts := spec.(*ast.TypeSpec)
+				if st, ok := ts.Type.(*ast.StructType); ok && ts.Name.Name == typeName {
+					return st, nil
+				}
+			}
+		}
+	}
+	return nil, fmt.Errorf("type %s not found", typeName)
+}
+
+// directiveName returns the Caddyfile name or usage line of a field, or ""
+// if the field is not configurable from the Caddyfile.
+func directiveName(field *ast.Field) string {
+	if field.Tag == nil || len(field.Names) == 0 || !field.Names[0].IsExported() {
+		return ""
+	}
+	tag := reflect.StructTag(strings.Trim(field.Tag.Value, "`"))
+	if name, ok := tag.Lookup("caddyfile"); ok {
+		if name == "-" {
+			return ""
+		}
+		return name
+	}
+	name, _, _ := strings.Cut(tag.Get("json"), ",")
+	if name == "-" {
+		return ""
+	}
+	return name
+}
+
+// placeholder describes the argument expected for a field type.
+func placeholder(expr ast.Expr) string {
+	switch t := expr.(type) {
+	case *ast.Ident:
+		switch t.Name {
+		case "string":
+			return "<string>"
+		case "bool":
+			return "[true|false]"
+		case "float32", "float64":
+			return "<number>"
+		case "int", "int64", "uint", "uint64":
+			return "<integer>"
+		}
+		return "<" + strings.ToLower(t.Name) + ">"
+	case *ast.SelectorExpr:
+		if t.Sel.Name == "Duration" {
+			return "<duration>"
+		}
+		return "<" + strings.ToLower(t.Sel.Name) + ">"
+	case *ast.ArrayType:
+		if elt, ok := t.Elt.(*ast.Ident); ok && ast.IsExported(elt.Name) {
+			// Slices of package types are configured with a block
+			return "{ ... }"
+		}
+		return strings.TrimSuffix(placeholder(t.Elt), ">") + "...>"
+	case *ast.StarExpr:
+		return placeholder(t.X)
+	}
+	return "<value>"
+}
+
+// fieldComment returns the trailing comment of a field, falling back to
+// the first sentence of its doc comment. A sentence ends at a period
+// followed by an uppercase letter, so abbreviations such as "e.g. /x" are
+// kept whole.
+func fieldComment(field *ast.Field) string {
+	group := field.Comment
+	if group == nil {
+		group = field.Doc
+	}
+	if group == nil {
+		return ""
+	}
+	text := strings.Join(strings.Fields(group.Text()), " ")
+	for i := 0; i+2 < len(text); i++ {
+		if text[i] == '.' && text[i+1] == ' ' && unicode.IsUpper(rune(text[i+2])) {
+			text = text[:i]
+			break
+		}
+	}
+	return strings.ReplaceAll(strings.TrimSuffix(text, "."), "`", "'")
+}
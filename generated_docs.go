@@ -0,0 +1,75 @@
+// Code generated by gendocs.go; DO NOT EDIT.
+
+package bchauth
+
+// CaddyfileSyntax is the Caddyfile syntax reference for the bchauth directive.
+const CaddyfileSyntax = `bchauth {
+    dest_wallet <wallet>...                     # Wallets that receive service payments; a payment to any of them counts
+    funds_ctn <number>                          # CTN amount required for 1 day of access
+    pg_conn_string <string>                     # Database connection string
+    configured_table <string>                   # Table name for transactions; superseded by pg_table
+    redis_addr <string>                         # Redis address, or comma-separated seed list in sentinel and cluster mode
+    whitelist <string...>                       # Public key whitelist
+    network_id <integer>                        # Network ID for blockchain addresses
+    db_driver <string>                          # Database driver: postgres (default), mysql or sqlite3
+    provision_timeout <duration>                # Deadline of the database and Redis pings at startup (default 10s)
+    query_timeout <duration>                    # Deadline of the cache lookups and access query of a request (default 5s)
+    pg_max_open_conns <integer>                 # Maximum open PostgreSQL connections (default 25)
+    pg_max_idle_conns <integer>                 # Maximum idle PostgreSQL connections (default 5)
+    pg_conn_max_lifetime <duration>             # Maximum lifetime of a PostgreSQL connection (default 5m)
+    pg_schema <string>                          # Schema of the transactions table (default public)
+    pg_table <string>                           # Transactions table (default configured_table, then transactions)
+    pg_replica_conn_string <string>             # Read replica that runs the access query, with the primary as fallback
+    pg_replica_pool_size <integer>              # Maximum open replica connections (default pg_max_open_conns)
+    pg_write_conn_string <string>               # Writable PostgreSQL database for bchauth's own tables (default pg_conn_string)
+    redis_mode <string>                         # Redis deployment: single (default), sentinel or cluster
+    redis_sentinel_master <string>              # Master name in sentinel mode
+    redis_password <string>                     # Redis password; may be a placeholder such as {env.REDIS_PASSWORD}
+    redis_tls_cert <string>                     # Client certificate for TLS connections to Redis
+    redis_tls_key <string>                      # Private key of redis_tls_cert
+    redis_tls_ca <string>                       # CA bundle used to verify the Redis server
+    optional_redis [true|false]                 # Run without redis_addr, or start while Redis is down, querying the database instead
+    expose_remaining_days [true|false]          # Set X-Service-Days-Remaining on authorized requests
+    routes { ... }                              # Per-path price overrides: routes { route <prefix> <funds_ctn> }
+    tiers { ... }                               # Named daily rates replacing funds_ctn: tiers { <name> <funds_ctn> }
+    require_signature [true|false]              # Require an Ed448 X-Signature over "METHOD URI X-Timestamp"
+    signature_max_age <duration>                # Maximum age of X-Timestamp (default 60s)
+    db_retry_attempts <integer>                 # Retries of a failed database or Redis call (default 3; 0 disables)
+    db_retry_backoff <duration>                 # Wait before the first retry, doubled for each further one (default 100ms)
+    cache_namespace <string>                    # Prefix of Redis keys, so instances can share a server (default bchauth)
+    negative_cache_ttl <duration>               # How long a denied key is answered from Redis (default 60s)
+    grace_period <duration>                     # How long access continues after the service ends (default 0)
+    metrics_enabled [true|false]                # Record Prometheus metrics (default true)
+    admin_path <string>                         # Path prefix of the status endpoint, e.g. /_bchauth
+    admin_secret <string>                       # Value required in X-Admin-Secret for admin_path
+    whitelist_entry <pubkey> [<rfc3339_expiry>] # Whitelisted key, optionally until an expiry time
+    whitelist_file <string>                     # File with one whitelisted public key per line
+    whitelist_reload_interval <duration>        # How often whitelist_file is re-read (default 60s)
+    pubkey_header <string>                      # Header carrying the public key (default X-Pub-Key); Bearer is stripped from Authorization
+    pubkey_cookie <string>                      # Cookie holding the URL-safe base64 public key when the header is absent
+    pubkey_source <string...>                   # Order in which the public key is looked up (default header cookie query)
+    pubkey_query_param <string>                 # Query parameter holding the public key, removed before the request is passed on
+    cache_warmup_interval <duration>            # How often near-expiry cache entries are refreshed (default disabled)
+    cache_warmup_lookahead <duration>           # Refresh entries expiring within this window (default 1h)
+    cache_warmup_query_limit <integer>          # Maximum entries refreshed per cycle (default 1000)
+    key_type <string>                           # Public key algorithm: ed448 (default), ed25519 or secp256k1
+    address_cache_size <integer>                # Derived addresses kept in memory (default 10000)
+    pubkey_encoding <string>                    # Encoding of X-Pub-Key: hex (default), base58 or base64
+    trusted_proxies <string...>                 # CIDR ranges of proxies whose X-Forwarded-For names the client
+    error_format <string>                       # Body of error responses: text (default) or json
+    dry_run [true|false]                        # Decide and log as usual, but pass every request on
+    rate_limit_rps <number>                     # Requests per second allowed per public key; 0 disables rate limiting
+    rate_limit_burst <integer>                  # Requests a key may send at once (default rate_limit_rps, at least 1)
+    rate_limit_ttl <duration>                   # How long an idle key keeps its limiter (default 10m)
+    max_service_days <integer>                  # Upper bound on cached service days (default 365)
+    max_tx_age <duration>                       # Ignore payments older than this (default unlimited)
+    billing_unit <string>                       # Period bought by funds_ctn: day (default) or hour
+    enable_linked_addresses [true|false]        # Count payments from addresses in bchauth_linked_addresses
+    match_sender [true|false]                   # Count payments from the key's address (from_addr) to dest_wallet instead of those to it
+    accumulate_partial_payments [true|false]    # Carry value beyond whole days over to later payments
+    webhook_url <string>                        # URL that is POSTed when a service is about to expire
+    webhook_notify_before <duration>            # How long before expiry the webhook is sent (default 72h)
+    webhook_secret <string>                     # Key of the X-BchAuth-Signature HMAC of webhook bodies
+    audit_log_table <string>                    # PostgreSQL table that records every access decision (default disabled)
+}
+`
@@ -0,0 +1,218 @@
+package bchauth
+
+import (
+	"crypto/ed25519"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	"github.com/core-coin/go-core/v2/common"
+	"github.com/core-coin/go-core/v2/crypto"
+	"github.com/decred/dcrd/dcrec/secp256k1/v4"
+	"github.com/decred/dcrd/dcrec/secp256k1/v4/ecdsa"
+	"golang.org/x/crypto/sha3"
+)
+
+// Key types accepted by key_type.
+const (
+	keyTypeEd448     = "ed448"
+	keyTypeEd25519   = "ed25519"
+	keyTypeSecp256k1 = "secp256k1"
+)
+
+// keyScheme validates the public keys of one signature algorithm and
+// derives the address that belongs to them.
+type keyScheme interface {
+	Validate(pubKey []byte) error
+	// Derive returns the address of pubKey in the form stored in the
+	// transactions table.
+	Derive(pubKey []byte) (string, error)
+	// Verify checks that sig is a signature by pubKey over hash.
+	Verify(pubKey, hash, sig []byte) bool
+}
+
+// newKeyScheme returns the scheme for keyType, deriving addresses with the
+// given network prefix. A secp256k1 scheme without a prefix derives
+// Ethereum addresses.
+func newKeyScheme(keyType string, prefix []byte) (keyScheme, error) {
+	switch keyType {
+	case "", keyTypeEd448:
+		return ed448Scheme{prefix: prefix}, nil
+	case keyTypeEd25519:
+		return ed25519Scheme{prefix: prefix}, nil
+	case keyTypeSecp256k1:
+		return secp256k1Scheme{prefix: prefix}, nil
+	default:
+		return nil, fmt.Errorf("unknown key_type %q", keyType)
+	}
+}
+
+// coreAddress derives the Core address of a public key: the last 20 bytes
+// of its SHA3 hash, preceded by the network prefix and checksum.
+func coreAddress(pubKey, prefix []byte) common.Address {
+	return withNetworkPrefix(crypto.SHA3(pubKey)[12:], prefix)
+}
+
+// withNetworkPrefix turns a 20-byte account hash into a Core address.
+func withNetworkPrefix(addr, prefix []byte) common.Address {
+	checksum := common.Hex2Bytes(common.CalculateChecksum(addr, prefix))
+	return common.BytesToAddress(append(append(append([]byte{}, prefix...), checksum...), addr...))
+}
+
+// oidEd448 identifies Ed448 keys in a SubjectPublicKeyInfo (RFC 8410).
+var oidEd448 = asn1.ObjectIdentifier{1, 3, 101, 113}
+
+// ed448SPKILength is the size of a DER-encoded Ed448 SubjectPublicKeyInfo:
+// a 12-byte header followed by the raw key.
+const ed448SPKILength = 12 + crypto.PubkeyLength
+
+// ed448Scheme handles the 57-byte Ed448 keys used natively by Core. Keys
+// exported by OpenSSL and some wallets as DER-encoded SubjectPublicKeyInfo
+// are accepted too and reduced to the raw key.
+type ed448Scheme struct {
+	prefix []byte
+}
+
+// raw returns the 57-byte key of pubKey, which is either raw or a
+// DER-encoded SubjectPublicKeyInfo.
+func (ed448Scheme) raw(pubKey []byte) ([]byte, error) {
+	switch len(pubKey) {
+	case crypto.PubkeyLength:
+		return pubKey, nil
+	case ed448SPKILength:
+		var spki struct {
+			Algorithm pkix.AlgorithmIdentifier
+			PublicKey asn1.BitString
+		}
+		rest, err := asn1.Unmarshal(pubKey, &spki)
+		if err != nil || len(rest) != 0 {
+			return nil, errors.New("invalid DER-encoded public key")
+		}
+		if !spki.Algorithm.Algorithm.Equal(oidEd448) || len(spki.Algorithm.Parameters.FullBytes) != 0 {
+			return nil, fmt.Errorf("DER-encoded public key is not Ed448 but %v", spki.Algorithm.Algorithm)
+		}
+		if spki.PublicKey.BitLength != crypto.PubkeyLength*8 {
+			return nil, errors.New("invalid DER-encoded public key")
+		}
+		return spki.PublicKey.Bytes, nil
+	default:
+		return nil, fmt.Errorf("invalid public key length %d: expected %d raw or %d DER-encoded bytes",
+			len(pubKey), crypto.PubkeyLength, ed448SPKILength)
+	}
+}
+
+func (s ed448Scheme) Validate(pubKey []byte) error {
+	_, err := s.raw(pubKey)
+	return err
+}
+
+func (s ed448Scheme) Derive(pubKey []byte) (string, error) {
+	pubKey, err := s.raw(pubKey)
+	if err != nil {
+		return "", err
+	}
+	return coreAddress(pubKey, s.prefix).Hex(), nil
+}
+
+func (s ed448Scheme) Verify(pubKey, hash, sig []byte) bool {
+	pubKey, err := s.raw(pubKey)
+	if err != nil {
+		return false
+	}
+	// crypto.VerifySignature expects the signature followed by the public key
+	if len(sig) == crypto.SignatureLength {
+		sig = append(sig[:len(sig):len(sig)], pubKey...)
+	}
+	return crypto.VerifySignature(pubKey, hash, sig)
+}
+
+// ed25519Scheme handles 32-byte Ed25519 keys.
+type ed25519Scheme struct {
+	prefix []byte
+}
+
+func (ed25519Scheme) Validate(pubKey []byte) error {
+	if len(pubKey) != ed25519.PublicKeySize {
+		return errors.New("invalid public key length")
+	}
+	return nil
+}
+
+func (s ed25519Scheme) Derive(pubKey []byte) (string, error) {
+	if err := s.Validate(pubKey); err != nil {
+		return "", err
+	}
+	return coreAddress(pubKey, s.prefix).Hex(), nil
+}
+
+func (ed25519Scheme) Verify(pubKey, hash, sig []byte) bool {
+	return ed25519.Verify(ed25519.PublicKey(pubKey), hash, sig)
+}
+
+// secp256k1Scheme handles the secp256k1 keys of Ethereum wallets, either
+// 65 bytes uncompressed (0x04 prefix) or 33 bytes compressed (0x02 or 0x03).
+// The account hash is the last 20 bytes of the Keccak-256 hash of the
+// uncompressed point. Without a network prefix the address is returned in
+// the Ethereum form, 0x followed by lowercase hex.
+type secp256k1Scheme struct {
+	prefix []byte
+}
+
+func (secp256k1Scheme) parse(pubKey []byte) (*secp256k1.PublicKey, error) {
+	switch {
+	case len(pubKey) == secp256k1.PubKeyBytesLenUncompressed && pubKey[0] == 0x04:
+	case len(pubKey) == secp256k1.PubKeyBytesLenCompressed && (pubKey[0] == 0x02 || pubKey[0] == 0x03):
+	case len(pubKey) == secp256k1.PubKeyBytesLenUncompressed || len(pubKey) == secp256k1.PubKeyBytesLenCompressed:
+		return nil, fmt.Errorf("invalid public key prefix 0x%02x", pubKey[0])
+	default:
+		return nil, errors.New("invalid public key length")
+	}
+	// ParsePubKey decompresses compressed keys and rejects points that
+	// are not on the curve
+	key, err := secp256k1.ParsePubKey(pubKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid public key: %v", err)
+	}
+	return key, nil
+}
+
+func (s secp256k1Scheme) Validate(pubKey []byte) error {
+	_, err := s.parse(pubKey)
+	return err
+}
+
+func (s secp256k1Scheme) Derive(pubKey []byte) (string, error) {
+	key, err := s.parse(pubKey)
+	if err != nil {
+		return "", err
+	}
+	h := sha3.NewLegacyKeccak256()
+	h.Write(key.SerializeUncompressed()[1:])
+	addr := h.Sum(nil)[12:]
+	if len(s.prefix) == 0 {
+		return "0x" + hex.EncodeToString(addr), nil
+	}
+	return withNetworkPrefix(addr, s.prefix).Hex(), nil
+}
+
+// Verify accepts a 64-byte r || s signature, or the 65-byte Ethereum form
+// with a trailing recovery byte, which is ignored.
+func (s secp256k1Scheme) Verify(pubKey, hash, sig []byte) bool {
+	if len(sig) == 65 {
+		sig = sig[:64]
+	}
+	if len(sig) != 64 {
+		return false
+	}
+	key, err := s.parse(pubKey)
+	if err != nil {
+		return false
+	}
+	var r, sv secp256k1.ModNScalar
+	if r.SetByteSlice(sig[:32]) || sv.SetByteSlice(sig[32:]) || r.IsZero() || sv.IsZero() {
+		return false
+	}
+	return ecdsa.NewSignature(&r, &sv).Verify(hash, key)
+}
@@ -0,0 +1,87 @@
+package bchauth
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Values of the result label of bchauth_requests_total.
+const (
+	resultAllowed     = "allowed"
+	resultDenied      = "denied"
+	resultWhitelisted = "whitelisted"
+	resultError       = "error"
+)
+
+var (
+	requestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "bchauth",
+		Name:      "requests_total",
+		Help:      "Authentication decisions by result.",
+	}, []string{"result"})
+
+	cacheHitsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "bchauth",
+		Name:      "cache_hits_total",
+		Help:      "Requests authorized from the Redis cache.",
+	})
+
+	dbQueryDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "bchauth",
+		Name:      "db_query_duration_seconds",
+		Help:      "Duration of access-check queries.",
+		Buckets:   prometheus.DefBuckets,
+	})
+
+	redisOpDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "bchauth",
+		Name:      "redis_op_duration_seconds",
+		Help:      "Duration of Redis operations by command.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"op"})
+)
+
+// Caddy's metrics endpoint serves the default registry, so the collectors
+// are registered there.
+func init() {
+	prometheus.DefaultRegisterer.MustRegister(
+		requestsTotal,
+		cacheHitsTotal,
+		dbQueryDuration,
+		redisOpDuration,
+	)
+}
+
+// metricsEnabled reports whether metrics are recorded, which is the default.
+func (bch *BchAuth) metricsEnabled() bool {
+	return bch.MetricsEnabled == nil || *bch.MetricsEnabled
+}
+
+// recordRequest counts an authentication decision.
+func (bch *BchAuth) recordRequest(result string) {
+	if bch.metricsEnabled() {
+		requestsTotal.WithLabelValues(result).Inc()
+	}
+}
+
+// recordCacheHit counts a request authorized from the cache.
+func (bch *BchAuth) recordCacheHit() {
+	if bch.metricsEnabled() {
+		cacheHitsTotal.Inc()
+	}
+}
+
+// observeDBQuery records the duration of an access-check query.
+func (bch *BchAuth) observeDBQuery(start time.Time) {
+	if bch.metricsEnabled() {
+		dbQueryDuration.Observe(time.Since(start).Seconds())
+	}
+}
+
+// observeRedisOp records the duration of a Redis command.
+func (bch *BchAuth) observeRedisOp(op string, start time.Time) {
+	if bch.metricsEnabled() {
+		redisOpDuration.WithLabelValues(op).Observe(time.Since(start).Seconds())
+	}
+}
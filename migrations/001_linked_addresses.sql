@@ -0,0 +1,12 @@
+-- Linked sender addresses for enable_linked_addresses.
+--
+-- Payments of linked_address count towards the service period of
+-- canonical_address, the address derived from the client's public key.
+-- Create the table in the same schema as the transactions table. The
+-- statements run on PostgreSQL, MySQL 8 and SQLite.
+
+CREATE TABLE IF NOT EXISTS bchauth_linked_addresses (
+    canonical_address VARCHAR(64) NOT NULL,
+    linked_address    VARCHAR(64) NOT NULL,
+    PRIMARY KEY (canonical_address, linked_address)
+);
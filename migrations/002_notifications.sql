@@ -0,0 +1,16 @@
+-- Expiry notifications for webhook_url.
+--
+-- bchauth records the end of the service period of each address it checks
+-- and sets notified_at once the expiry webhook was delivered. A new
+-- expires_at, after a top-up, clears notified_at again. Create the table in
+-- pg_schema. The statements run on PostgreSQL.
+
+CREATE TABLE IF NOT EXISTS bchauth_notifications (
+    address     VARCHAR(64) PRIMARY KEY,
+    expires_at  TIMESTAMPTZ NOT NULL,
+    notified_at TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS bchauth_notifications_pending
+    ON bchauth_notifications (expires_at)
+    WHERE notified_at IS NULL;
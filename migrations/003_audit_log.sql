@@ -0,0 +1,21 @@
+-- Audit log for audit_log_table.
+--
+-- bchauth inserts one row per access decision. result holds the reason
+-- that is also logged, such as active or service_expired. Rename the table
+-- to match audit_log_table and create it in pg_schema of the write
+-- database (pg_write_conn_string, or pg_conn_string without it) unless the
+-- option names a schema. The statements run on PostgreSQL.
+
+CREATE TABLE IF NOT EXISTS bchauth_audit_log (
+    id             BIGSERIAL PRIMARY KEY,
+    ts             TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    pub_key        TEXT NOT NULL,
+    address        TEXT NOT NULL,
+    result         TEXT NOT NULL,
+    active_days    INT NOT NULL,
+    client_ip      TEXT NOT NULL,
+    request_path   TEXT NOT NULL,
+    request_method TEXT NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS bchauth_audit_log_ts ON bchauth_audit_log (ts);
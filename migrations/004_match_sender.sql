@@ -0,0 +1,13 @@
+-- Sender column for match_sender.
+--
+-- By default a transaction counts for the address in its to_addr column.
+-- With match_sender, it counts for the address in from_addr instead, and
+-- only when to_addr is one of dest_wallet. Whatever fills the transactions
+-- table must then write the sender to from_addr. Run in the transactions
+-- schema before enabling the option. The statements run on PostgreSQL; on
+-- MySQL and SQLite, drop IF NOT EXISTS from the ALTER TABLE.
+
+ALTER TABLE transactions ADD COLUMN IF NOT EXISTS from_addr VARCHAR(64);
+
+CREATE INDEX IF NOT EXISTS transactions_from_to
+    ON transactions (from_addr, to_addr, created_at);
@@ -0,0 +1,178 @@
+package bchauth
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/mr-tron/base58"
+)
+
+// Public key sources accepted by pubkey_source.
+const (
+	pubKeySourceHeader = "header"
+	pubKeySourceCookie = "cookie"
+	pubKeySourceQuery  = "query"
+)
+
+// defaultPubKeyHeader carries the public key when pubkey_header is not set.
+const defaultPubKeyHeader = "X-Pub-Key"
+
+// Public key encodings accepted by pubkey_encoding.
+const (
+	pubKeyEncodingHex    = "hex"
+	pubKeyEncodingBase58 = "base58"
+	pubKeyEncodingBase64 = "base64"
+)
+
+// decodePublicKey decodes a public key sent in encoding. An empty encoding
+// is hex, which may carry a 0x prefix. Base64 is the standard alphabet with
+// optional padding.
+func decodePublicKey(s, encoding string) ([]byte, error) {
+	switch encoding {
+	case "", pubKeyEncodingHex:
+		return hex.DecodeString(strings.TrimPrefix(strings.TrimPrefix(s, "0x"), "0X"))
+	case pubKeyEncodingBase58:
+		return base58.Decode(s)
+	case pubKeyEncodingBase64:
+		return base64.RawStdEncoding.DecodeString(strings.TrimRight(s, "="))
+	}
+	return nil, fmt.Errorf("unknown pubkey_encoding %q", encoding)
+}
+
+// encodePublicKey is the inverse of decodePublicKey.
+func encodePublicKey(raw []byte, encoding string) string {
+	switch encoding {
+	case pubKeyEncodingBase58:
+		return base58.Encode(raw)
+	case pubKeyEncodingBase64:
+		return base64.StdEncoding.EncodeToString(raw)
+	}
+	return hex.EncodeToString(raw)
+}
+
+// publicKeyMatcher returns a func that reports whether a key is pubKey in
+// encoding. Keys are compared decoded, so hex in either case or with a 0x
+// prefix matches; a key that does not decode only matches exactly.
+func publicKeyMatcher(pubKey, encoding string) func(string) bool {
+	raw, err := decodePublicKey(pubKey, encoding)
+	if err != nil {
+		return func(key string) bool { return key == pubKey }
+	}
+	return func(key string) bool {
+		other, err := decodePublicKey(key, encoding)
+		if err != nil {
+			return key == pubKey
+		}
+		return bytes.Equal(other, raw)
+	}
+}
+
+// defaultPubKeySource is the lookup order when pubkey_source is not set.
+var defaultPubKeySource = []string{pubKeySourceHeader, pubKeySourceCookie, pubKeySourceQuery}
+
+// validatePubKeySource checks that every entry names a known source.
+func validatePubKeySource(sources []string) error {
+	for _, source := range sources {
+		switch source {
+		case pubKeySourceHeader, pubKeySourceCookie, pubKeySourceQuery:
+		default:
+			return fmt.Errorf("unknown pubkey_source %q", source)
+		}
+	}
+	return nil
+}
+
+// pubKeyFromRequest returns the public key of r, in pubkey_encoding, from
+// the first source in pubkey_source that provides one, or "" if none does.
+func (bch *BchAuth) pubKeyFromRequest(r *http.Request) string {
+	sources := bch.PubKeySource
+	if len(sources) == 0 {
+		sources = defaultPubKeySource
+	}
+	for _, source := range sources {
+		var pubKey string
+		switch source {
+		case pubKeySourceHeader:
+			pubKey = bch.pubKeyFromHeader(r)
+		case pubKeySourceCookie:
+			pubKey = bch.pubKeyFromCookie(r)
+		case pubKeySourceQuery:
+			if bch.PubKeyQueryParam != "" {
+				pubKey = r.URL.Query().Get(bch.PubKeyQueryParam)
+			}
+		}
+		if pubKey != "" {
+			return pubKey
+		}
+	}
+	return ""
+}
+
+// pubKeyHeader returns the name of the header that carries the public key.
+func (bch *BchAuth) pubKeyHeader() string {
+	if bch.PubKeyHeader == "" {
+		return defaultPubKeyHeader
+	}
+	return bch.PubKeyHeader
+}
+
+// pubKeyFromHeader reads the pubkey_header header. In an Authorization
+// header the key follows the Bearer scheme, which is stripped.
+func (bch *BchAuth) pubKeyFromHeader(r *http.Request) string {
+	name := bch.pubKeyHeader()
+	value := r.Header.Get(name)
+	if http.CanonicalHeaderKey(name) == "Authorization" {
+		if len(value) >= len("Bearer ") && strings.EqualFold(value[:len("Bearer ")], "Bearer ") {
+			value = value[len("Bearer "):]
+		}
+		value = strings.TrimSpace(value)
+	}
+	return value
+}
+
+// pubKeyFromCookie reads the pubkey_cookie cookie. Its value is the public
+// key encoded as URL-safe base64, with or without padding; it is returned
+// in pubkey_encoding like the pubkey_header header.
+func (bch *BchAuth) pubKeyFromCookie(r *http.Request) string {
+	if bch.PubKeyCookie == "" {
+		return ""
+	}
+	cookie, err := r.Cookie(bch.PubKeyCookie)
+	if err != nil {
+		return ""
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(cookie.Value, "="))
+	if err != nil || len(raw) == 0 {
+		return ""
+	}
+	return encodePublicKey(raw, bch.PubKeyEncoding)
+}
+
+// stripPubKeyQuery removes pubkey_query_param from the query of r, so the
+// key is not passed on to upstream services. The other parameters keep
+// their order and encoding.
+func (bch *BchAuth) stripPubKeyQuery(r *http.Request) {
+	if bch.PubKeyQueryParam == "" || r.URL.RawQuery == "" {
+		return
+	}
+	r.URL.RawQuery = stripQueryParam(r.URL.RawQuery, bch.PubKeyQueryParam)
+}
+
+// stripQueryParam returns rawQuery without the parameters named name.
+func stripQueryParam(rawQuery, name string) string {
+	pairs := strings.Split(rawQuery, "&")
+	kept := pairs[:0]
+	for _, pair := range pairs {
+		key, _, _ := strings.Cut(pair, "=")
+		if k, err := url.QueryUnescape(key); err == nil && k == name {
+			continue
+		}
+		kept = append(kept, pair)
+	}
+	return strings.Join(kept, "&")
+}
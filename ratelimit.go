@@ -0,0 +1,82 @@
+package bchauth
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// defaultRateLimitTTL is how long an idle key keeps its limiter.
+const defaultRateLimitTTL = 10 * time.Minute
+
+// keyLimiter is the token bucket of one public key, or of one client IP
+// for requests whose key is malformed.
+type keyLimiter struct {
+	limiter  *rate.Limiter
+	lastSeen atomic.Int64 // Unix nanoseconds
+}
+
+// allowRequest reports whether r, sent with pubKey, is within
+// rate_limit_rps. Limiters are created on first use and always allow when
+// rate limiting is off.
+func (bch *BchAuth) allowRequest(r *http.Request, pubKey string) bool {
+	if bch.RateLimitRPS <= 0 {
+		return true
+	}
+	key := bch.rateLimitKey(r, pubKey)
+	v, ok := bch.limiters.Load(key)
+	if !ok {
+		v, _ = bch.limiters.LoadOrStore(key, &keyLimiter{
+			limiter: rate.NewLimiter(rate.Limit(bch.RateLimitRPS), bch.rateLimitBurst()),
+		})
+	}
+	l := v.(*keyLimiter)
+	l.lastSeen.Store(time.Now().UnixNano())
+	return l.limiter.Allow()
+}
+
+// rateLimitKey returns the limiter key of r: the decoded public key when
+// it is valid for key_type, so that every spelling of a key shares one
+// limiter, or else the client IP, so that arbitrary header values cannot
+// each claim a limiter of their own.
+func (bch *BchAuth) rateLimitKey(r *http.Request, pubKey string) string {
+	if raw, err := decodePublicKey(pubKey, bch.PubKeyEncoding); err == nil {
+		if scheme, err := bch.scheme(); err == nil && scheme.Validate(raw) == nil {
+			return "key:" + string(raw)
+		}
+	}
+	return "ip:" + bch.clientIP(r)
+}
+
+// rateLimitBurst returns rate_limit_burst, by default rate_limit_rps and at
+// least 1.
+func (bch *BchAuth) rateLimitBurst() int {
+	if bch.RateLimitBurst == 0 {
+		return max(1, int(bch.RateLimitRPS))
+	}
+	return bch.RateLimitBurst
+}
+
+// purgeLimiters drops the limiters of keys idle for longer than ttl, every
+// ttl, until ctx is done.
+func (bch *BchAuth) purgeLimiters(ctx context.Context, ttl time.Duration) {
+	ticker := time.NewTicker(ttl)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			cutoff := now.Add(-ttl).UnixNano()
+			bch.limiters.Range(func(key, v interface{}) bool {
+				if v.(*keyLimiter).lastSeen.Load() < cutoff {
+					bch.limiters.Delete(key)
+				}
+				return true
+			})
+		}
+	}
+}
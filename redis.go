@@ -0,0 +1,101 @@
+package bchauth
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Redis deployment modes accepted by redis_mode.
+const (
+	redisModeSingle   = "single"
+	redisModeSentinel = "sentinel"
+	redisModeCluster  = "cluster"
+)
+
+// newRedisClient builds the Redis client for the configured redis_mode.
+// In sentinel and cluster mode RedisAddr is a comma-separated seed list.
+func (bch *BchAuth) newRedisClient() (redis.UniversalClient, error) {
+	password := bch.RedisPassword
+	tlsConfig, err := bch.redisTLSConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	switch bch.RedisMode {
+	case "", redisModeSingle:
+		return redis.NewClient(&redis.Options{
+			Addr:      bch.RedisAddr,
+			Password:  password,
+			TLSConfig: tlsConfig,
+		}), nil
+	case redisModeSentinel:
+		if bch.RedisSentinelMaster == "" {
+			return nil, fmt.Errorf("redis_sentinel_master is required in sentinel mode")
+		}
+		return redis.NewFailoverClient(&redis.FailoverOptions{
+			MasterName:    bch.RedisSentinelMaster,
+			SentinelAddrs: splitAddrs(bch.RedisAddr),
+			Password:      password,
+			TLSConfig:     tlsConfig,
+		}), nil
+	case redisModeCluster:
+		return redis.NewClusterClient(&redis.ClusterOptions{
+			Addrs:     splitAddrs(bch.RedisAddr),
+			Password:  password,
+			TLSConfig: tlsConfig,
+		}), nil
+	default:
+		return nil, fmt.Errorf("unknown redis_mode %q", bch.RedisMode)
+	}
+}
+
+// redisTLSConfig loads the client certificate and CA named by redis_tls_*.
+// It returns nil when none is set, so the connection stays in plain text.
+// Files are read here so that a bad path fails provisioning rather than the
+// first request.
+func (bch *BchAuth) redisTLSConfig() (*tls.Config, error) {
+	certFile, keyFile, caFile := bch.RedisTLSCert, bch.RedisTLSKey, bch.RedisTLSCA
+	if certFile == "" && keyFile == "" && caFile == "" {
+		return nil, nil
+	}
+
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	if certFile != "" || keyFile != "" {
+		if certFile == "" || keyFile == "" {
+			return nil, fmt.Errorf("redis_tls_cert and redis_tls_key must be set together")
+		}
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load Redis client certificate: %v", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read Redis CA: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in Redis CA %s", caFile)
+		}
+		cfg.RootCAs = pool
+	}
+	return cfg, nil
+}
+
+// splitAddrs splits a comma-separated address list, dropping empty entries.
+func splitAddrs(list string) []string {
+	var addrs []string
+	for _, addr := range strings.Split(list, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
+}
@@ -0,0 +1,68 @@
+package bchauth
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"math/rand/v2"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Retry defaults for transient database and Redis errors.
+const (
+	defaultDBRetryAttempts = 3
+	defaultDBRetryBackoff  = 100 * time.Millisecond
+)
+
+// retryAttempts returns how many times a failed call is retried.
+func (bch *BchAuth) retryAttempts() int {
+	if bch.DBRetryAttempts == nil {
+		return defaultDBRetryAttempts
+	}
+	return *bch.DBRetryAttempts
+}
+
+// retryable reports whether err may go away on a second try. Application
+// results such as a Redis miss or an empty result set are final, and so
+// is a cancelled or expired context.
+func retryable(err error) bool {
+	return !errors.Is(err, redis.Nil) &&
+		!errors.Is(err, sql.ErrNoRows) &&
+		!errors.Is(err, context.Canceled) &&
+		!errors.Is(err, context.DeadlineExceeded)
+}
+
+// withRetry calls fn until it succeeds, fails with an error that is not
+// retryable, or db_retry_attempts retries are used up. The wait before
+// retry n (from 0) is db_retry_backoff * 2^n, half of it randomized to
+// spread out clients that failed together. Waiting stops when ctx is done.
+func (bch *BchAuth) withRetry(ctx context.Context, fn func() error) error {
+	err := fn()
+	for attempt := 0; attempt < bch.retryAttempts() && err != nil && retryable(err); attempt++ {
+		backoff := time.Duration(bch.DBRetryBackoff) << attempt
+		if half := int64(backoff / 2); half > 0 {
+			backoff = time.Duration(half + rand.Int64N(half))
+		}
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+		err = fn()
+	}
+	return err
+}
+
+// withCacheRetry is withRetry for Redis calls. With optional_redis a
+// failed call is not retried, since the database decides access anyway and
+// waiting for Redis would only delay the request.
+func (bch *BchAuth) withCacheRetry(ctx context.Context, fn func() error) error {
+	if bch.OptionalRedis {
+		return fn()
+	}
+	return bch.withRetry(ctx, fn)
+}
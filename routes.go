@@ -0,0 +1,54 @@
+package bchauth
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+// RoutePrice overrides the required funds for the paths under Prefix.
+type RoutePrice struct {
+	Prefix      string  `json:"prefix"`
+	MinFundsCTN float64 `json:"funds_ctn"` // CTN amount required for 1 day of access
+}
+
+// routeFor returns the price override with the longest prefix matching
+// path, or nil if none matches.
+func (bch *BchAuth) routeFor(path string) *RoutePrice {
+	var best *RoutePrice
+	for i := range bch.Routes {
+		route := &bch.Routes[i]
+		if strings.HasPrefix(path, route.Prefix) && (best == nil || len(route.Prefix) > len(best.Prefix)) {
+			best = route
+		}
+	}
+	return best
+}
+
+// unmarshalRoutes parses a routes block:
+//
+//	routes {
+//	    route /premium/* 2.0
+//	    route /basic/* 0.5
+//	}
+func (bch *BchAuth) unmarshalRoutes(d *caddyfile.Dispenser) error {
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		if d.Val() != "route" {
+			return d.Errf("unrecognized routes option %q", d.Val())
+		}
+		var prefix, fundsCTNStr string
+		if !d.Args(&prefix, &fundsCTNStr) {
+			return d.Err("expected path prefix and funds_ctn for route")
+		}
+		fundsCTN, err := strconv.ParseFloat(fundsCTNStr, 64)
+		if err != nil {
+			return d.Err("invalid value for route funds_ctn")
+		}
+		bch.Routes = append(bch.Routes, RoutePrice{
+			Prefix:      strings.TrimSuffix(prefix, "*"),
+			MinFundsCTN: fundsCTN,
+		})
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+package bchauth
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/core-coin/go-core/v2/crypto"
+)
+
+// defaultSignatureMaxAge is how far X-Timestamp may be from the current
+// time when signature_max_age is not set.
+const defaultSignatureMaxAge = 60 * time.Second
+
+// verifySignature checks the X-Signature header of r against pubKey.
+//
+// The signature is the base64-encoded signature, made with the configured
+// key type, of the SHA3-256 hash of the canonical request string
+// "METHOD URI UNIX_TIMESTAMP", where URI is the request URI and
+// UNIX_TIMESTAMP is the value of the X-Timestamp header.
+func (bch *BchAuth) verifySignature(r *http.Request, pubKey string) error {
+	sigHeader := r.Header.Get("X-Signature")
+	tsHeader := r.Header.Get("X-Timestamp")
+	if sigHeader == "" || tsHeader == "" {
+		return errors.New("missing X-Signature or X-Timestamp")
+	}
+
+	ts, err := strconv.ParseInt(tsHeader, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid X-Timestamp: %v", err)
+	}
+	maxAge := time.Duration(bch.SignatureMaxAge)
+	if maxAge == 0 {
+		maxAge = defaultSignatureMaxAge
+	}
+	if age := time.Since(time.Unix(ts, 0)); age > maxAge || age < -maxAge {
+		return errors.New("X-Timestamp outside the allowed window")
+	}
+
+	sig, err := base64.StdEncoding.DecodeString(sigHeader)
+	if err != nil {
+		return fmt.Errorf("invalid X-Signature encoding: %v", err)
+	}
+	scheme, err := bch.scheme()
+	if err != nil {
+		return err
+	}
+	pubKeyBytes, err := decodePublicKey(pubKey, bch.PubKeyEncoding)
+	if err != nil {
+		return fmt.Errorf("invalid public key encoding: %v", err)
+	}
+	if err := scheme.Validate(pubKeyBytes); err != nil {
+		return err
+	}
+
+	canonical := r.Method + " " + r.URL.RequestURI() + " " + tsHeader
+	if !scheme.Verify(pubKeyBytes, crypto.SHA3([]byte(canonical)), sig) {
+		return errors.New("signature verification failed")
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+package bchauth
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// accessStatus is the response body of the {admin_path}/status endpoint.
+type accessStatus struct {
+	Address       string `json:"address"`
+	RemainingDays int    `json:"remaining_days"`
+	Tier          string `json:"tier,omitempty"`
+	CacheExpires  string `json:"cache_expires,omitempty"`
+	Version       string `json:"version"` // Module version, as reported by /bchauth/version
+}
+
+// isAdminRequest reports whether r targets the configured admin_path.
+func (bch *BchAuth) isAdminRequest(r *http.Request) bool {
+	if bch.AdminPath == "" {
+		return false
+	}
+	return r.URL.Path == bch.AdminPath || strings.HasPrefix(r.URL.Path, bch.AdminPath+"/")
+}
+
+// serveAdmin handles requests under admin_path. They are authorized with
+// the X-Admin-Secret header instead of blockchain access.
+func (bch *BchAuth) serveAdmin(w http.ResponseWriter, r *http.Request) error {
+	secret := r.Header.Get("X-Admin-Secret")
+	if subtle.ConstantTimeCompare([]byte(secret), []byte(bch.AdminSecret)) != 1 {
+		bch.writeError(w, "Forbidden", http.StatusForbidden)
+		return nil
+	}
+
+	if strings.TrimPrefix(r.URL.Path, bch.AdminPath) != "/status" {
+		bch.writeError(w, "Not Found", http.StatusNotFound)
+		return nil
+	}
+	if r.Method != http.MethodGet {
+		bch.writeError(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return nil
+	}
+	return bch.serveStatus(w, r)
+}
+
+// serveStatus reports the service state of the key in the pubkey query
+// parameter without touching the cache.
+func (bch *BchAuth) serveStatus(w http.ResponseWriter, r *http.Request) error {
+	ctx, cancel := context.WithTimeout(r.Context(), time.Duration(bch.QueryTimeout))
+	defer cancel()
+	pubKey := r.URL.Query().Get("pubkey")
+	address, err := bch.generateAddress(pubKey)
+	if err != nil {
+		bch.writeError(w, "Invalid Public Key", http.StatusBadRequest)
+		return nil
+	}
+
+	endDate, tier, err := bch.checkAccess(ctx, address, bch.MinFundsCTN, true)
+	if err != nil {
+		bch.writeError(w, "Internal Server Error", http.StatusInternalServerError)
+		return nil
+	}
+
+	status := accessStatus{Address: address, Version: ReadBuildInfo().Version}
+	if time.Now().Before(endDate) {
+		status.RemainingDays = remainingDays(endDate)
+		status.Tier = tier
+	}
+	if bch.RedisClient != nil {
+		expiry, err := bch.RedisClient.Get(ctx, bch.redisKey("access", pubKey)).Result()
+		if err != nil && !errors.Is(err, redis.Nil) && !bch.OptionalRedis {
+			bch.writeError(w, "Internal Server Error", http.StatusInternalServerError)
+			return nil
+		}
+		if expiresAt, _, parseErr := parseCacheValue(expiry); err == nil && parseErr == nil {
+			status.CacheExpires = expiresAt.UTC().Format(time.RFC3339)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(status)
+}
@@ -0,0 +1,99 @@
+package bchauth
+
+import (
+	"cmp"
+	"context"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+// Tier is a named service level priced at FundsCTN per day.
+type Tier struct {
+	Name     string  `json:"name"`
+	FundsCTN float64 `json:"funds_ctn"` // CTN amount required for 1 day of the tier
+}
+
+// sortTiers orders the tiers from the most to the least expensive.
+func (bch *BchAuth) sortTiers() {
+	slices.SortStableFunc(bch.Tiers, func(a, b Tier) int {
+		return cmp.Compare(b.FundsCTN, a.FundsCTN)
+	})
+}
+
+// checkAccess returns the end of the paid service period of address at
+// minFunds per day. When tiered is set and tiers are configured, it returns
+// the period at the most expensive tier the payments sustain for at least
+// a day instead, together with the name of that tier. Tiers are tried in
+// order, so a miss costs one query per tier until one is active.
+func (bch *BchAuth) checkAccess(ctx context.Context, address string, minFunds float64, tiered bool) (time.Time, string, error) {
+	if !tiered || len(bch.Tiers) == 0 {
+		endDate, err := bch.AccessChecker.CheckActiveService(ctx, address, bch.DestWallets, minFunds)
+		return endDate, "", err
+	}
+	for _, tier := range bch.Tiers {
+		endDate, err := bch.AccessChecker.CheckActiveService(ctx, address, bch.DestWallets, tier.FundsCTN)
+		if err != nil {
+			return time.Time{}, "", err
+		}
+		if time.Now().Before(endDate) {
+			return endDate, tier.Name, nil
+		}
+	}
+	return time.Time{}, "", nil
+}
+
+// cacheValue encodes a cached grant as the Unix end time, followed by
+// ":<tier>" when the grant has a tier.
+func cacheValue(endDate time.Time, tier string) string {
+	v := strconv.FormatInt(endDate.Unix(), 10)
+	if tier != "" {
+		v += ":" + tier
+	}
+	return v
+}
+
+// parseCacheValue decodes a value written by cacheValue. Entries written
+// before tiers existed hold only the end time.
+func parseCacheValue(v string) (time.Time, string, error) {
+	expiry, tier, _ := strings.Cut(v, ":")
+	expiresAt, err := strconv.ParseInt(expiry, 10, 64)
+	if err != nil {
+		return time.Time{}, "", err
+	}
+	return time.Unix(expiresAt, 0), tier, nil
+}
+
+// setTier reports the tier of an authorized request in the X-Service-Tier
+// response header.
+func setTier(w http.ResponseWriter, tier string) {
+	if tier != "" {
+		w.Header().Set("X-Service-Tier", tier)
+	}
+}
+
+// unmarshalTiers parses a tiers block:
+//
+//	tiers {
+//	    pro 5
+//	    basic 1
+//	}
+func (bch *BchAuth) unmarshalTiers(d *caddyfile.Dispenser) error {
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		name := d.Val()
+		var fundsCTNStr string
+		if !d.Args(&fundsCTNStr) {
+			return d.Errf("expected funds_ctn for tier %s", name)
+		}
+		fundsCTN, err := strconv.ParseFloat(fundsCTNStr, 64)
+		if err != nil || fundsCTN <= 0 {
+			return d.Errf("invalid funds_ctn for tier %s", name)
+		}
+		bch.Tiers = append(bch.Tiers, Tier{Name: name, FundsCTN: fundsCTN})
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+package bchauth
+
+import "runtime/debug"
+
+// Version is the release version of the bchauth module.
+const Version = "v0.1.0"
+
+// Build metadata, set at link time:
+//
+//	go build -ldflags "-X github.com/DataLayerHost/bchauth.buildVersion=v0.1.0 \
+//		-X github.com/DataLayerHost/bchauth.buildCommit=$(git rev-parse HEAD) \
+//		-X github.com/DataLayerHost/bchauth.buildDate=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+var (
+	buildVersion string
+	buildCommit  string
+	buildDate    string
+)
+
+const modulePath = "github.com/DataLayerHost/bchauth"
+
+// BuildInfo describes the build of the module that is running.
+type BuildInfo struct {
+	Version string `json:"version"`
+	Commit  string `json:"commit,omitempty"`
+	Date    string `json:"date,omitempty"`
+}
+
+// ReadBuildInfo returns the build information set via ldflags. When the
+// version was not set at link time, the module version recorded in the
+// binary is used, and Version if that is unavailable too.
+func ReadBuildInfo() BuildInfo {
+	info := BuildInfo{Version: buildVersion, Commit: buildCommit, Date: buildDate}
+	if info.Version != "" {
+		return info
+	}
+
+	info.Version = Version
+	bi, ok := debug.ReadBuildInfo()
+	if !ok {
+		return info
+	}
+	mod := &bi.Main
+	for _, dep := range bi.Deps {
+		if dep.Path == modulePath {
+			mod = dep
+			break
+		}
+	}
+	if mod.Path != modulePath {
+		return info
+	}
+	if mod.Replace != nil {
+		mod = mod.Replace
+	}
+	if mod.Version != "" && mod.Version != "(devel)" {
+		info.Version = mod.Version
+	}
+	if mod == &bi.Main {
+		for _, s := range bi.Settings {
+			switch s.Key {
+			case "vcs.revision":
+				if info.Commit == "" {
+					info.Commit = s.Value
+				}
+			case "vcs.time":
+				if info.Date == "" {
+					info.Date = s.Value
+				}
+			}
+		}
+	}
+	return info
+}
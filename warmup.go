@@ -0,0 +1,99 @@
+package bchauth
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"go.uber.org/zap"
+)
+
+// Cache warm-up defaults.
+const (
+	defaultCacheWarmupLookahead  = time.Hour
+	defaultCacheWarmupQueryLimit = 1000
+)
+
+// warmupSetKey is the Redis sorted set, under cache_namespace, of cached
+// keys scored by the Unix time at which their cache entry expires.
+const warmupSetKey = "warmup"
+
+// warmupKey returns the name of the warm-up set under cache_namespace.
+func (bch *BchAuth) warmupKey() string {
+	return bch.CacheNamespace + ":" + warmupSetKey
+}
+
+// trackForWarmup records a cached key so the warm-up loop can refresh it
+// before it expires. Only keys cached at the top-level price are tracked.
+func (bch *BchAuth) trackForWarmup(ctx context.Context, pubKey, address string, endDate time.Time) {
+	if bch.CacheWarmupInterval <= 0 || bch.RedisClient == nil {
+		return
+	}
+	bch.RedisClient.ZAdd(ctx, bch.warmupKey(), &redis.Z{
+		Score:  float64(endDate.Unix()),
+		Member: pubKey + "|" + address,
+	})
+}
+
+// warmCache refreshes near-expiry cache entries every interval until ctx
+// is done.
+func (bch *BchAuth) warmCache(ctx context.Context, interval time.Duration, logger *zap.Logger) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := bch.warmCacheOnce(ctx, logger); err != nil && ctx.Err() == nil {
+				logger.Warn("cache warm-up failed", zap.Error(err))
+			}
+		}
+	}
+}
+
+// warmCacheOnce re-checks up to cache_warmup_query_limit keys whose cache
+// entry expires within cache_warmup_lookahead. Keys that renewed get a new
+// entry, so their next request does not miss. Keys that expired, or whose
+// service still ends within the lookahead, are dropped from the set, so
+// they are not queried again on every cycle; the next request that reaches
+// the database tracks them again.
+func (bch *BchAuth) warmCacheOnce(ctx context.Context, logger *zap.Logger) error {
+	horizon := time.Now().Add(time.Duration(bch.CacheWarmupLookahead))
+	members, err := bch.RedisClient.ZRangeByScore(ctx, bch.warmupKey(), &redis.ZRangeBy{
+		Min:   "-inf",
+		Max:   strconv.FormatInt(horizon.Unix(), 10),
+		Count: int64(bch.CacheWarmupQueryLimit),
+	}).Result()
+	if err != nil {
+		return err
+	}
+
+	for _, member := range members {
+		pubKey, address, _ := strings.Cut(member, "|")
+		endDate, tier, err := bch.checkAccess(ctx, address, bch.MinFundsCTN, true)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			logger.Warn("cache warm-up check failed", zap.String("address", address), zap.Error(err))
+			continue
+		}
+
+		endDate = bch.capEndDate(endDate)
+		cacheDuration := time.Until(endDate)
+		if cacheDuration <= 0 {
+			bch.RedisClient.ZRem(ctx, bch.warmupKey(), member)
+			continue
+		}
+		bch.RedisClient.Set(ctx, bch.redisKey("access", pubKey), cacheValue(endDate, tier), cacheDuration)
+		if !endDate.After(horizon) {
+			bch.RedisClient.ZRem(ctx, bch.warmupKey(), member)
+			continue
+		}
+		bch.RedisClient.ZAdd(ctx, bch.warmupKey(), &redis.Z{Score: float64(endDate.Unix()), Member: member})
+	}
+	return nil
+}
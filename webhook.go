@@ -0,0 +1,198 @@
+package bchauth
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Expiry webhook defaults.
+const (
+	defaultWebhookNotifyBefore = 72 * time.Hour
+	webhookPollInterval        = time.Minute
+	webhookBatchSize           = 100
+	webhookRetries             = 3
+	webhookBackoff             = time.Second
+)
+
+// notificationsTable records the service end date of each address and when
+// the expiry webhook was sent for it. It lives in the write database, see
+// migrations/002_notifications.sql.
+const notificationsTable = "bchauth_notifications"
+
+var webhookClient = &http.Client{Timeout: 10 * time.Second}
+
+// expiryNotice is the JSON body posted to webhook_url.
+type expiryNotice struct {
+	Address   string    `json:"address"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// notificationsTableName returns notificationsTable qualified with
+// pg_schema, if set.
+func (bch *BchAuth) notificationsTableName() string {
+	if bch.PGSchema != "" {
+		return bch.PGSchema + "." + notificationsTable
+	}
+	return notificationsTable
+}
+
+// recordExpiry stores the end of the service period of address, so the
+// webhook loop knows when to notify. A changed end date, after a top-up,
+// arms the notification again.
+func (bch *BchAuth) recordExpiry(ctx context.Context, address string, endDate time.Time) error {
+	table := bch.notificationsTableName()
+	_, err := bch.WriteDB.ExecContext(ctx, fmt.Sprintf(`
+		INSERT INTO %s (address, expires_at) VALUES ($1, $2)
+		ON CONFLICT (address) DO UPDATE
+		SET expires_at = EXCLUDED.expires_at, notified_at = NULL
+		WHERE %s.expires_at <> EXCLUDED.expires_at`, table, table),
+		address, endDate)
+	return err
+}
+
+// notifyExpiring sends the expiry webhook every webhookPollInterval until
+// ctx is done.
+func (bch *BchAuth) notifyExpiring(ctx context.Context, logger *zap.Logger) {
+	ticker := time.NewTicker(webhookPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := bch.notifyExpiringOnce(ctx, logger); err != nil && ctx.Err() == nil {
+				logger.Warn("expiry notification failed", zap.Error(err))
+			}
+		}
+	}
+}
+
+// notifyExpiringOnce posts the webhook for recorded addresses whose service
+// ends within webhook_notify_before and that were not notified yet. Each
+// address is re-checked first, since a top-up may have extended its
+// service without a request that would update the record. An address is
+// claimed before the webhook is sent, so instances sharing the table do
+// not notify twice, and released again if every attempt fails.
+func (bch *BchAuth) notifyExpiringOnce(ctx context.Context, logger *zap.Logger) error {
+	table := bch.notificationsTableName()
+	horizon := time.Now().Add(time.Duration(bch.WebhookNotifyBefore))
+	rows, err := bch.WriteDB.QueryContext(ctx, fmt.Sprintf(`
+		SELECT address, expires_at FROM %s
+		WHERE notified_at IS NULL AND expires_at > NOW() AND expires_at <= $1
+		ORDER BY expires_at
+		LIMIT $2`, table),
+		horizon, webhookBatchSize)
+	if err != nil {
+		return err
+	}
+	var due []expiryNotice
+	for rows.Next() {
+		var n expiryNotice
+		if err := rows.Scan(&n.Address, &n.ExpiresAt); err != nil {
+			rows.Close()
+			return err
+		}
+		due = append(due, n)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, n := range due {
+		endDate, _, err := bch.checkAccess(ctx, n.Address, bch.MinFundsCTN, true)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			logger.Warn("expiry re-check failed", zap.String("address", n.Address), zap.Error(err))
+			continue
+		}
+		if endDate.After(horizon) {
+			if err := bch.recordExpiry(ctx, n.Address, endDate); err != nil {
+				logger.Warn("failed to record service end", zap.String("address", n.Address), zap.Error(err))
+			}
+			continue
+		}
+
+		res, err := bch.WriteDB.ExecContext(ctx, fmt.Sprintf(
+			`UPDATE %s SET notified_at = NOW() WHERE address = $1 AND expires_at = $2 AND notified_at IS NULL`, table),
+			n.Address, n.ExpiresAt)
+		if err != nil {
+			return err
+		}
+		if claimed, err := res.RowsAffected(); err != nil || claimed == 0 {
+			continue
+		}
+
+		if err := bch.sendWebhook(ctx, n); err != nil {
+			logger.Error("expiry webhook failed", zap.String("address", n.Address), zap.Error(err))
+			if _, err := bch.WriteDB.ExecContext(context.WithoutCancel(ctx), fmt.Sprintf(
+				`UPDATE %s SET notified_at = NULL WHERE address = $1 AND expires_at = $2`, table),
+				n.Address, n.ExpiresAt); err != nil {
+				logger.Warn("failed to release expiry notification", zap.String("address", n.Address), zap.Error(err))
+			}
+		}
+	}
+	return nil
+}
+
+// sendWebhook posts n to webhook_url, retrying up to webhookRetries times
+// with exponential backoff. Any status other than 2xx is a failure. With
+// webhook_secret set, X-BchAuth-Signature carries the hex HMAC-SHA256 of
+// the body, keyed with the secret.
+func (bch *BchAuth) sendWebhook(ctx context.Context, n expiryNotice) error {
+	n.ExpiresAt = n.ExpiresAt.UTC()
+	body, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+	var signature string
+	if bch.WebhookSecret != "" {
+		mac := hmac.New(sha256.New, []byte(bch.WebhookSecret))
+		mac.Write(body)
+		signature = "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	}
+
+	send := func() error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, bch.WebhookURL, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		if signature != "" {
+			req.Header.Set("X-BchAuth-Signature", signature)
+		}
+		resp, err := webhookClient.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			return fmt.Errorf("webhook returned %s", resp.Status)
+		}
+		return nil
+	}
+
+	err = send()
+	for attempt := 0; attempt < webhookRetries && err != nil; attempt++ {
+		timer := time.NewTimer(webhookBackoff << attempt)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+		err = send()
+	}
+	return err
+}
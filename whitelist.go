@@ -0,0 +1,236 @@
+package bchauth
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// defaultWhitelistReloadInterval is how often whitelist_file is re-read
+// when whitelist_reload_interval is not set.
+const defaultWhitelistReloadInterval = 60 * time.Second
+
+// WhitelistEntry grants access to PubKey until Expires. A zero Expires
+// never expires.
+type WhitelistEntry struct {
+	PubKey  string
+	Expires time.Time
+}
+
+// whitelistEntryJSON is the JSON form of WhitelistEntry, with Expires as
+// a Unix timestamp so it round-trips through the config API.
+type whitelistEntryJSON struct {
+	PubKey  string `json:"pub_key"`
+	Expires int64  `json:"expires,omitempty"`
+}
+
+// MarshalJSON encodes Expires as a Unix timestamp, omitted when zero.
+func (e WhitelistEntry) MarshalJSON() ([]byte, error) {
+	entry := whitelistEntryJSON{PubKey: e.PubKey}
+	if !e.Expires.IsZero() {
+		entry.Expires = e.Expires.Unix()
+	}
+	return json.Marshal(entry)
+}
+
+// UnmarshalJSON decodes the form written by MarshalJSON.
+func (e *WhitelistEntry) UnmarshalJSON(data []byte) error {
+	var entry whitelistEntryJSON
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return err
+	}
+	e.PubKey = entry.PubKey
+	e.Expires = time.Time{}
+	if entry.Expires != 0 {
+		e.Expires = time.Unix(entry.Expires, 0).UTC()
+	}
+	return nil
+}
+
+// active reports whether the entry grants access at now.
+func (e WhitelistEntry) active(now time.Time) bool {
+	return e.Expires.IsZero() || now.Before(e.Expires)
+}
+
+// fileWhitelist holds the public keys loaded from whitelist_file and those
+// added through the admin API.
+type fileWhitelist struct {
+	encoding string // pubkey_encoding of the keys
+
+	mu   sync.RWMutex
+	keys []string
+
+	// writeMu orders file writes and reloads, so a reload cannot
+	// resurrect the file contents from before an admin change.
+	writeMu sync.Mutex
+}
+
+// contains reports whether pubKey is in the loaded keys.
+func (fw *fileWhitelist) contains(pubKey string) bool {
+	match := publicKeyMatcher(pubKey, fw.encoding)
+	fw.mu.RLock()
+	defer fw.mu.RUnlock()
+	return slices.ContainsFunc(fw.keys, match)
+}
+
+// list returns a copy of the keys.
+func (fw *fileWhitelist) list() []string {
+	fw.mu.RLock()
+	defer fw.mu.RUnlock()
+	return append([]string(nil), fw.keys...)
+}
+
+// update adds or removes pubKey and, when path is set, writes the result
+// to path. It reports whether the keys changed. If the file cannot be
+// written, the keys are left as they were.
+func (fw *fileWhitelist) update(pubKey string, add bool, path string) (bool, error) {
+	fw.writeMu.Lock()
+	defer fw.writeMu.Unlock()
+
+	match := publicKeyMatcher(pubKey, fw.encoding)
+	fw.mu.Lock()
+	previous := fw.keys
+	i := slices.IndexFunc(previous, match)
+	changed := (i < 0) == add
+	switch {
+	case !changed:
+	case add:
+		fw.keys = append(slices.Clip(previous), pubKey)
+	default:
+		fw.keys = slices.Delete(slices.Clone(previous), i, i+1)
+	}
+	keys := fw.keys
+	fw.mu.Unlock()
+
+	if !changed || path == "" {
+		return changed, nil
+	}
+	if err := writeWhitelistFile(path, keys); err != nil {
+		fw.mu.Lock()
+		fw.keys = previous
+		fw.mu.Unlock()
+		return false, err
+	}
+	return true, nil
+}
+
+// load replaces the keys with the contents of path.
+func (fw *fileWhitelist) load(path string) error {
+	fw.writeMu.Lock()
+	defer fw.writeMu.Unlock()
+	keys, err := readWhitelistFile(path)
+	if err != nil {
+		return err
+	}
+	fw.mu.Lock()
+	fw.keys = keys
+	fw.mu.Unlock()
+	return nil
+}
+
+// readWhitelistFile reads one public key per line. Blank lines and lines
+// starting with # are ignored.
+func readWhitelistFile(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var keys []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		keys = append(keys, line)
+	}
+	return keys, scanner.Err()
+}
+
+// writeWhitelistFile replaces path with one key per line. The keys are
+// written to a temporary file in the same directory that is then renamed
+// over path, so readers never see a partial file. The new file keeps the
+// mode of path and, where permitted, its owner and group.
+func writeWhitelistFile(path string, keys []string) error {
+	f, err := os.CreateTemp(filepath.Dir(path), ".whitelist-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if fi, err := os.Stat(path); err == nil {
+		if err := f.Chmod(fi.Mode().Perm()); err != nil {
+			f.Close()
+			return err
+		}
+		copyOwner(f, fi)
+	}
+
+	w := bufio.NewWriter(f)
+	for _, key := range keys {
+		w.WriteString(key + "\n")
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// reloadWhitelist re-reads whitelist_file every interval until ctx is done.
+// A failed reload keeps the previously loaded keys.
+func (bch *BchAuth) reloadWhitelist(ctx context.Context, interval time.Duration, logger *zap.Logger) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := bch.fileWhitelist.load(bch.WhitelistFile); err != nil {
+				logger.Warn("failed to reload whitelist file",
+					zap.String("whitelist_file", bch.WhitelistFile),
+					zap.Error(err))
+			}
+		}
+	}
+}
+
+// isWhitelisted checks if the public key is in the whitelist.
+func (bch *BchAuth) isWhitelisted(pubKey string) bool {
+	return bch.staticWhitelisted(pubKey) || (bch.fileWhitelist != nil && bch.fileWhitelist.contains(pubKey))
+}
+
+// staticWhitelisted reports whether pubKey is whitelisted by the config
+// itself, through whitelist or an unexpired whitelist_entry. The admin API
+// cannot remove such keys.
+func (bch *BchAuth) staticWhitelisted(pubKey string) bool {
+	match := publicKeyMatcher(pubKey, bch.PubKeyEncoding)
+	if slices.ContainsFunc(bch.Whitelist, match) {
+		return true
+	}
+	now := time.Now()
+	for _, entry := range bch.WhitelistEntries {
+		if match(entry.PubKey) && entry.active(now) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,8 @@
+//go:build !unix
+
+package bchauth
+
+import "os"
+
+// copyOwner is a no-op where files have no Unix owner.
+func copyOwner(*os.File, os.FileInfo) {}
@@ -0,0 +1,16 @@
+//go:build unix
+
+package bchauth
+
+import (
+	"os"
+	"syscall"
+)
+
+// copyOwner gives f the owner and group of fi. Without the privilege to
+// do so, f keeps those of the process.
+func copyOwner(f *os.File, fi os.FileInfo) {
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		_ = f.Chown(int(st.Uid), int(st.Gid))
+	}
+}